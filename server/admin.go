@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type AdminConfig struct {
+	Addr         string // host:port, 和业务端口分开
+	EnablePprof  bool   // /debug/pprof/
+	EnableExpvar bool   // /debug/vars, 会发布名为 kanna.<ID> 的变量
+}
+
+type ConnInfo struct {
+	ID         int       `json:"id"`
+	Network    string    `json:"network"`
+	RemoteAddr string    `json:"remote_addr"`
+	LastActive time.Time `json:"last_active"`
+	Telnet     bool      `json:"telnet"`
+	Session    bool      `json:"session"` // token可以用来resume, 不输出
+	Groups     []string  `json:"groups,omitempty"`
+}
+
+// 启动管理用的HTTP服务, 返回的http.Server可以用来Close
+func (c *KannaServer) ListenAdmin(config AdminConfig) (*http.Server, error) {
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: c.AdminHandler(config)}
+	go srv.Serve(listener)
+
+	return srv, nil
+}
+
+func (c *KannaServer) AdminHandler(config AdminConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/debug/conns", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.ConnInfos())
+	})
+
+	if config.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	if config.EnableExpvar {
+		name := "kanna." + c.ID
+		if expvar.Get(name) == nil {
+			expvar.Publish(name, expvar.Func(func() interface{} { return c.Stats() }))
+		}
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+
+	return mux
+}
+
+// CloseAllConn之后或者没有正在accept的listener时返回error
+func (c *KannaServer) Ready() error {
+	if atomic.LoadInt32(&c.shuttingDown) == 1 {
+		return fmt.Errorf("shutting down")
+	}
+
+	if atomic.LoadInt32(&c.listeners) <= 0 {
+		return fmt.Errorf("no listener")
+	}
+
+	return nil
+}
+
+func (c *KannaServer) Stats() map[string]interface{} {
+	c.topicLock.RLock()
+	topics := len(c.topics)
+	c.topicLock.RUnlock()
+
+	c.groupLock.RLock()
+	groups := len(c.groups)
+	c.groupLock.RUnlock()
+
+	c.sessionLock.Lock()
+	sessions := len(c.sessions)
+	c.sessionLock.Unlock()
+
+	return map[string]interface{}{
+		"conns":      len(c.GetConns()),
+		"listeners":  atomic.LoadInt32(&c.listeners),
+		"send_count": c.GetSendCount(),
+		"topics":     topics,
+		"groups":     groups,
+		"sessions":   sessions,
+	}
+}
+
+// 按ID排序
+func (c *KannaServer) ConnInfos() []ConnInfo {
+	groups := make(map[int][]string)
+	c.groupLock.RLock()
+	for name, g := range c.groups {
+		for id := range g.members {
+			groups[id] = append(groups[id], name)
+		}
+	}
+	c.groupLock.RUnlock()
+
+	var res []ConnInfo
+	for _, conn := range c.GetConns() {
+		info := ConnInfo{ID: conn.GetID(), Groups: groups[conn.GetID()]}
+		sort.Strings(info.Groups)
+
+		var core *sKannaConnection
+		var raw net.Conn
+		switch v := conn.(type) {
+		case *KannaTCPConnection:
+			core, raw, info.Network = v.sKannaConnection, v.Conn, "tcp"
+		case *KannaUnixSocketConnection:
+			core, raw, info.Network = v.sKannaConnection, v.Conn, "unix"
+		case *KannaNetConnection:
+			core, raw, info.Network = v.sKannaConnection, v.Conn, "net"
+		case *KannaEventLoopConnection:
+			core, raw, info.Network = v.sKannaConnection, v.Conn, v.Conn.LocalAddr().Network()+"/epoll"
+		}
+
+		if raw != nil && raw.RemoteAddr() != nil {
+			info.RemoteAddr = raw.RemoteAddr().String()
+		}
+
+		if core != nil {
+			info.LastActive = time.Unix(0, atomic.LoadInt64(&core.last))
+			info.Telnet = core.allowTelnet()
+		}
+		info.Session = conn.GetSession() != nil
+
+		res = append(res, info)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 拒绝连接时发送 reject{reason} 后断开
+const OpReject = "reject"
+
+var ErrConnDenied = errors.New("address denied")
+var ErrTooManyConns = errors.New("too many connections")
+var ErrTooManyConnsPerIP = errors.New("too many connections from this address")
+
+const rejectWriteTimeout = time.Second
+
+type admission struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	total   int
+	perIP   map[string]int
+	connIPs map[int]string
+	lock    sync.Mutex
+}
+
+func newAdmission() *admission {
+	return &admission{
+		perIP:   make(map[string]int),
+		connIPs: make(map[int]string),
+	}
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, cidr := range cidrs {
+		// 单个IP当作/32或/128
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ipNet)
+	}
+
+	return res, nil
+}
+
+// 设置允许连接的网段, 不为空时只有匹配的地址可以连接, 替换之前的设置
+func (c *KannaServer) SetAllowCIDRs(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	c.admission.lock.Lock()
+	c.admission.allow = nets
+	c.admission.lock.Unlock()
+	return nil
+}
+
+// 设置拒绝连接的网段, 优先于allow, 替换之前的设置
+func (c *KannaServer) SetDenyCIDRs(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	c.admission.lock.Lock()
+	c.admission.deny = nets
+	c.admission.lock.Unlock()
+	return nil
+}
+
+func matchIPNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unix socket和net.Pipe没有IP, 返回空
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP.String()
+	case *net.UDPAddr:
+		return v.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+
+	return host
+}
+
+// 检查通过后计入连接数, 连接停止时通过releaseAdmission释放
+func (c *KannaServer) admit(id int, ip string) error {
+	a := c.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if ip != "" {
+		parsed := net.ParseIP(ip)
+		if matchIPNets(a.deny, parsed) {
+			return ErrConnDenied
+		}
+
+		if len(a.allow) > 0 && !matchIPNets(a.allow, parsed) {
+			return ErrConnDenied
+		}
+	}
+
+	if max := c.MaxConns; max > 0 && a.total >= max {
+		return ErrTooManyConns
+	}
+
+	if max := c.MaxConnsPerIP; max > 0 && ip != "" && a.perIP[ip] >= max {
+		return ErrTooManyConnsPerIP
+	}
+
+	a.total++
+	a.connIPs[id] = ip
+	if ip != "" {
+		a.perIP[ip]++
+	}
+
+	return nil
+}
+
+func (c *KannaServer) releaseAdmission(id int) {
+	a := c.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ip, ok := a.connIPs[id]
+	if !ok {
+		return
+	}
+
+	delete(a.connIPs, id)
+	a.total--
+	if ip == "" {
+		return
+	}
+
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+func (c *KannaServer) rejectFrame(err error) []byte {
+	if c.RejectFrame != nil {
+		return c.RejectFrame(err)
+	}
+
+	pack := NewDataPack(OpReject)
+	pack.PushData(err.Error())
+	return pack.Pack()
+}
+
+// 还没有Start的连接, 写入拒绝帧后关闭socket
+// 写超时最长要等rejectWriteTimeout, 放在单独的协程里, 不阻塞accept
+func (c *KannaServer) reject(conn net.Conn, err error) {
+	frame := c.rejectFrame(err)
+	go func() {
+		if len(frame) > 0 {
+			conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+			conn.Write(frame)
+		}
+
+		conn.Close()
+	}()
+}
+
+// OnConnStart拒绝的连接没有启动过读写协程, 和stop一样清理, 但不触发OnConnEnd
+// OnConnStart里可能已经加入了分组或订阅了topic
+func (c *sKannaConnection) markRejected(conn IKannaConnBehavior) {
+	c.stopOnce.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		close(c.ExitBuffChan)
+
+		c.cancelAllPushes()
+		c.Server.RemoveConn(conn)
+		c.Server.releaseAdmission(c.ID)
+		c.Server.leaveAllGroups(conn)
+		c.release(conn)
+	})
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// net.Pipe没有IP, 换成指定的远端地址
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// 从ip连过来, 被拒绝时返回nil和读到的拒绝原因
+func serveFrom(t *testing.T, s *KannaServer, ip string) (IKannaConnBehavior, string) {
+	c1, c2 := net.Pipe()
+	client := NewKannaClient(c1)
+	client.Conn.SetDeadline(time.Now().Add(time.Second * 2))
+	t.Cleanup(func() { client.Close() })
+
+	conn := s.ServeConn(&addrConn{c2, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000}}, nil)
+	if conn != nil {
+		t.Cleanup(conn.Stop)
+		return conn, ""
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("%s: read reject: %v", ip, err)
+	}
+
+	if frame.Op != OpReject {
+		t.Fatalf("%s: got %s, want %s", ip, frame.Op, OpReject)
+	}
+
+	return nil, frame.Values()[0]
+}
+
+func TestAdmissionCIDR(t *testing.T) {
+	s := NewKananServer()
+	if err := s.SetAllowCIDRs("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDenyCIDRs("10.0.0.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ip     string
+		reason string
+	}{
+		{"10.0.0.1", ""},
+		{"10.0.0.5", ErrConnDenied.Error()},
+		{"192.168.1.1", ErrConnDenied.Error()},
+	}
+
+	for _, c := range cases {
+		if _, reason := serveFrom(t, s, c.ip); reason != c.reason {
+			t.Errorf("%s: got reason %q, want %q", c.ip, reason, c.reason)
+		}
+	}
+
+	if err := s.SetAllowCIDRs("bad"); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
+
+// 连接停止后释放名额
+func TestMaxConnsPerIP(t *testing.T) {
+	s := NewKananServer()
+	s.MaxConnsPerIP = 1
+
+	conn, _ := serveFrom(t, s, "1.2.3.4")
+	if conn == nil {
+		t.Fatal("first conn rejected")
+	}
+
+	if _, reason := serveFrom(t, s, "1.2.3.4"); reason != ErrTooManyConnsPerIP.Error() {
+		t.Fatalf("second conn got reason %q", reason)
+	}
+
+	if other, _ := serveFrom(t, s, "1.2.3.5"); other == nil {
+		t.Fatal("conn from another ip rejected")
+	}
+
+	conn.Stop()
+	if again, reason := serveFrom(t, s, "1.2.3.4"); again == nil {
+		t.Fatalf("conn after release rejected: %s", reason)
+	}
+}
+
+// OnConnStart拒绝时清理分组, 订阅和名额, 不触发OnConnEnd
+func TestOnConnStartRejectTeardown(t *testing.T) {
+	s := NewKananServer()
+	s.MaxConns = 1
+	reject := true
+	s.OnConnStart = func(conn IKannaConnBehavior) error {
+		s.JoinGroup(conn, "acct")
+		s.Subscribe(conn, "ticker")
+		if reject {
+			return errors.New("no auth")
+		}
+		return nil
+	}
+	s.OnConnEnd = func(conn IKannaConnBehavior) {
+		t.Error("OnConnEnd called for rejected conn")
+	}
+
+	if _, reason := serveFrom(t, s, "1.2.3.4"); reason != "no auth" {
+		t.Fatalf("got reason %q, want no auth", reason)
+	}
+
+	if s.GetGroup("acct") != nil {
+		t.Error("rejected conn left in group")
+	}
+
+	if n := s.GetSubscribers("ticker"); n != 0 {
+		t.Errorf("rejected conn left %d subscribers", n)
+	}
+
+	if n := len(s.GetConns()); n != 0 {
+		t.Errorf("rejected conn left %d conns", n)
+	}
+
+	reject = false
+	s.OnConnEnd = nil
+	if conn, _ := serveFrom(t, s, "1.2.3.4"); conn == nil {
+		t.Fatal("MaxConns slot not released")
+	}
+}
+
+// 对端不读时拒绝也不能阻塞ServeConn
+func TestRejectDoesNotBlock(t *testing.T) {
+	s := NewKananServer()
+	s.SetDenyCIDRs("1.2.3.4")
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	start := time.Now()
+	if conn := s.ServeConn(&addrConn{c2, &net.TCPAddr{IP: net.ParseIP("1.2.3.4")}}, nil); conn != nil {
+		t.Fatal("denied conn accepted")
+	}
+
+	if d := time.Since(start); d > rejectWriteTimeout/2 {
+		t.Fatalf("ServeConn blocked %v on reject", d)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// 帧里的值用\t \n , }分隔, 任意字节的数据用Binary包一下, 编码为 b64:base64
+type Binary []byte
+
+const binaryPrefix = "b64:"
+
+func (b Binary) String() string {
+	return binaryPrefix + base64.StdEncoding.EncodeToString(b)
+}
+
+func (b Binary) writeTo(buf *bytes.Buffer) {
+	buf.WriteString(binaryPrefix)
+	enc := base64.NewEncoder(base64.StdEncoding, buf)
+	enc.Write(b)
+	enc.Close()
+}
+
+func (b Binary) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *Binary) UnmarshalText(text []byte) error {
+	res, err := DecodeBinary(string(text))
+	if err != nil {
+		return err
+	}
+
+	*b = res
+	return nil
+}
+
+// 解析b64:开头的值
+func DecodeBinary(s string) (Binary, error) {
+	if !strings.HasPrefix(s, binaryPrefix) {
+		return nil, fmt.Errorf("binary value should start with %s", binaryPrefix)
+	}
+
+	return base64.StdEncoding.DecodeString(s[len(binaryPrefix):])
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBinaryPackRoundTrip(t *testing.T) {
+	raw := Binary("\x00\t\n,}{\xff已成交")
+
+	pack := NewDataPack("blob")
+	pack.SetMsgId("1")
+	pack.PushData(raw, "tail")
+
+	frame, err := DecodeFrame(pack.Pack(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := frame.Values()
+	if len(vals) != 2 || vals[1] != "tail" {
+		t.Fatalf("got values %q", vals)
+	}
+
+	got, err := DecodeBinary(vals[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, raw) {
+		t.Fatalf("got %q, want %q", got, raw)
+	}
+}
+
+func TestBinaryText(t *testing.T) {
+	raw := Binary{0, 1, 2, 0xfe, 0xff}
+
+	text, err := raw.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(text) != raw.String() {
+		t.Fatalf("MarshalText %q != String %q", text, raw.String())
+	}
+
+	var got Binary
+	if err := got.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, raw) {
+		t.Fatalf("got %v, want %v", got, raw)
+	}
+}
+
+func TestDecodeBinaryInvalid(t *testing.T) {
+	for _, s := range []string{"", "AAEC", "b64:not base64!"} {
+		if _, err := DecodeBinary(s); err == nil {
+			t.Errorf("DecodeBinary(%q) should fail", s)
+		}
+	}
+}
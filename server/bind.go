@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 结构体字段按声明顺序对应参数/列, tag格式为 kanna:"name,required", kanna:"-" 跳过
+// decimal.Decimal这类实现了encoding.TextUnmarshaler的类型直接用UnmarshalText解析
+const bindTag = "kanna"
+
+type bindField struct {
+	index    int
+	name     string
+	required bool
+}
+
+var bindFieldCache sync.Map // reflect.Type -> []bindField
+
+var timeType = reflect.TypeOf(time.Time{})
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func getBindFields(t reflect.Type) []bindField {
+	if v, ok := bindFieldCache.Load(t); ok {
+		return v.([]bindField)
+	}
+
+	var fields []bindField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := f.Tag.Get(bindTag)
+		if tag == "-" {
+			continue
+		}
+
+		field := bindField{index: i, name: f.Name}
+		opts := strings.Split(tag, ",")
+		if opts[0] != "" {
+			field.name = opts[0]
+		}
+
+		for _, opt := range opts[1:] {
+			if opt == "required" {
+				field.required = true
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	bindFieldCache.Store(t, fields)
+	return fields
+}
+
+// 按字段顺序把参数解析到v, v必须是结构体指针, 出错时返回*SpecError
+func (o *OpCmd) Bind(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("bind: want pointer to struct, got %T", v)
+	}
+
+	rv = rv.Elem()
+	args := cmdArgs(o)
+	for k, field := range getBindFields(rv.Type()) {
+		value := ""
+		if k < len(args) {
+			value = strings.TrimSpace(args[k])
+		}
+
+		if value == "" {
+			if field.required {
+				return &SpecError{Code: ErrCodeMissingArg, Field: field.name, Message: "is required"}
+			}
+
+			continue
+		}
+
+		if err := setBindValue(rv.Field(field.index), value); err != nil {
+			return &SpecError{Code: ErrCodeBadType, Field: field.name, Message: err.Error()}
+		}
+	}
+
+	return nil
+}
+
+func setBindValue(fv reflect.Value, value string) error {
+	if fv.Type() == timeType {
+		t, err := ParseArgTime(value)
+		if err != nil {
+			return fmt.Errorf("want time")
+		}
+
+		fv.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	if fv.CanAddr() && fv.Addr().Type().Implements(textUnmarshalerType) {
+		return fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("want int")
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("want uint")
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("want decimal")
+		}
+		fv.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("want bool")
+		}
+		fv.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
+
+	return nil
+}
+
+// 把结构体按字段顺序展开成一行, time.Time输出为毫秒时间戳, 零值为0
+func (p *DataPack) PushStruct(v interface{}) {
+	p.PushData(structValues(v)...)
+}
+
+// v为结构体的slice, 每个元素一行, 会把pack切换为多行
+func (p *DataPack) PushStructs(v interface{}) {
+	p.Multi()
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		p.PushStruct(v)
+		return
+	}
+
+	for i := 0; i < rv.Len(); i++ {
+		p.PushData(structValues(rv.Index(i).Interface())...)
+	}
+}
+
+func structValues(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return []interface{}{v}
+	}
+
+	fields := getBindFields(rv.Type())
+	res := make([]interface{}, len(fields))
+	for k, field := range fields {
+		fv := rv.Field(field.index).Interface()
+		if t, ok := fv.(time.Time); ok {
+			fv = 0
+			if !t.IsZero() {
+				fv = t.UnixNano() / int64(time.Millisecond)
+			}
+		}
+		res[k] = fv
+	}
+
+	return res
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type bindOrder struct {
+	Symbol   string          `kanna:"symbol,required"`
+	Qty      int             `kanna:"qty"`
+	Price    decimal.Decimal `kanna:"price"`
+	Rate     float64         `kanna:"rate"`
+	PostOnly bool            `kanna:"post_only"`
+	Created  time.Time       `kanna:"created"`
+	Note     string          `kanna:"-"`
+}
+
+// PushStruct打包的一行用Bind解析回来和原来相同
+func TestBindRoundTrip(t *testing.T) {
+	in := bindOrder{
+		Symbol:   "BTC-USDT",
+		Qty:      3,
+		Price:    decimal.RequireFromString("43210.12345678"),
+		Rate:     0.25,
+		PostOnly: true,
+		Created:  time.Unix(1700000000, 123*int64(time.Millisecond)),
+		Note:     "skipped",
+	}
+
+	pack := NewDataPack("order")
+	pack.PushStruct(&in)
+	frame, err := DecodeFrame(pack.Pack(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := frame.Values()
+	if len(values) != 6 {
+		t.Fatalf("got %d columns %q, want 6", len(values), values)
+	}
+
+	var out bindOrder
+	if err := (&OpCmd{Op: "order", Args: values}).Bind(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Symbol != in.Symbol || out.Qty != in.Qty || !out.Price.Equal(in.Price) || out.Rate != in.Rate ||
+		out.PostOnly != in.PostOnly || !out.Created.Equal(in.Created) || out.Note != "" {
+		t.Fatalf("got %+v, want %+v", out, in)
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	cases := []struct {
+		line  string
+		code  string
+		field string
+	}{
+		{"order{BTC-USDT,1,1.5}1", "", ""},
+		{"order{}1", ErrCodeMissingArg, "symbol"},
+		{"order{BTC-USDT,x}1", ErrCodeBadType, "qty"},
+		{"order{BTC-USDT,1,abc}1", ErrCodeBadType, "price"},
+		{"order{BTC-USDT,1,1,1,maybe}1", ErrCodeBadType, "post_only"},
+	}
+
+	for _, c := range cases {
+		var out bindOrder
+		err := ParseOp([]byte(c.line)).Bind(&out)
+		if c.code == "" {
+			if err != nil {
+				t.Errorf("%s: %v", c.line, err)
+			}
+			continue
+		}
+
+		specErr, ok := err.(*SpecError)
+		if !ok || specErr.Code != c.code || specErr.Field != c.field {
+			t.Errorf("%s: got %v, want %s %s", c.line, err, c.code, c.field)
+		}
+	}
+
+	var out bindOrder
+	if err := ParseOp([]byte("order{BTC}1")).Bind(out); err == nil {
+		t.Error("Bind to non-pointer returned nil")
+	}
+}
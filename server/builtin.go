@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bytes"
+)
+
+// 由连接自己处理的op, 不会交给MsgHandler
+func (c *sKannaConnection) isBuiltinOp(op string) bool {
+	switch op {
+	case OpCompress:
+		return c.Server.enableCompression()
+	case OpResume:
+		return c.Server.EnableSession
+	case OpAck:
+		return c.Server.EnableReliable
+	case OpHello:
+		return c.Server.EnableHello
+	case OpCancel:
+		return c.hasPushes()
+	}
+
+	return false
+}
+
+// 只看op名, 不解析参数
+func (c *sKannaConnection) isBuiltinFrame(data []byte) bool {
+	begin := bytes.IndexByte(data, '{')
+	return begin != -1 && c.isBuiltinOp(string(bytes.TrimSpace(data[:begin])))
+}
+
+// 返回true表示该消息已被处理
+func (c *sKannaConnection) handleBuiltinOp(conn IKannaConnBehavior, data []byte) bool {
+	if !c.isBuiltinFrame(data) {
+		return false
+	}
+
+	cmd := ParseOp(data)
+	if cmd == nil {
+		return false
+	}
+
+	switch cmd.Op {
+	case OpCompress:
+		c.handleCompressHandshake(conn, cmd)
+	case OpResume:
+		c.handleResume(conn, cmd)
+	case OpAck:
+		c.handleAck(cmd)
+	case OpHello:
+		c.handleHello(conn, cmd)
+	case OpCancel:
+		return c.handleCancel(conn, cmd)
+	}
+
+	return true
+}
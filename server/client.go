@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 客户端收到的一帧
+type Frame struct {
+	*OpCmd
+	Rows  [][]string // DataPack的内容, 按\n分行, 按\t分列
+	Seq   uint64     // 可靠帧的序号, 普通帧为0
+	Flags uint32     // 包头上的标记位
+	Raw   []byte     // 收到的原始数据, 含包头
+
+	Chunk      byte   // 分块帧的标记, ChunkBegin/ChunkContinue/ChunkEnd
+	ChunkIndex uint32 // 分块帧的序号
+}
+
+// 第一行的列
+func (f *Frame) Values() []string {
+	if len(f.Rows) == 0 {
+		return nil
+	}
+
+	return f.Rows[0]
+}
+
+// 拼一个客户端发给服务端的帧, 参数用逗号分隔
+func EncodeCmd(op string, msgId string, args ...string) []byte {
+	return encodeLine(op + "{" + strings.Join(args, ",") + "}" + msgId)
+}
+
+func encodeLine(body string) []byte {
+	return EncodeFrame([]byte(body))
+}
+
+// 给帧体加上包头
+func EncodeFrame(body []byte) []byte {
+	res := make([]byte, PackHeadLen+len(body))
+	binary.BigEndian.PutUint32(res, uint32(len(body)))
+	copy(res[PackHeadLen:], body)
+
+	return res
+}
+
+// 解析带包头的一帧, 压缩帧需要传入协商好的codec
+func DecodeFrame(b []byte, codec Compressor) (*Frame, error) {
+	if len(b) < PackHeadLen {
+		return nil, fmt.Errorf("frame too short: %q", b)
+	}
+
+	msgLen := binary.BigEndian.Uint32(b)
+	body := b[PackHeadLen:]
+	if int(msgLen&^frameFlagMask) != len(body) {
+		return nil, fmt.Errorf("frame length mismatch, head %d body %d", msgLen&^frameFlagMask, len(body))
+	}
+
+	if msgLen&FrameFlagCompressed != 0 {
+		if codec == nil {
+			return nil, fmt.Errorf("compressed frame without codec")
+		}
+
+		var err error
+		if body, err = codec.Decompress(body); err != nil {
+			return nil, err
+		}
+	}
+
+	frame := &Frame{Flags: msgLen & frameFlagMask, Raw: b}
+	if msgLen&FrameFlagReliable != 0 {
+		if len(body) < reliableSeqLen {
+			return nil, fmt.Errorf("reliable frame too short")
+		}
+
+		frame.Seq = binary.BigEndian.Uint64(body)
+		body = body[reliableSeqLen:]
+	}
+
+	if msgLen&FrameFlagChunk != 0 {
+		if len(body) < chunkPrefixLen {
+			return nil, fmt.Errorf("chunk frame too short")
+		}
+
+		frame.Chunk = body[0]
+		frame.ChunkIndex = binary.BigEndian.Uint32(body[1:])
+		body = body[chunkPrefixLen:]
+	}
+
+	cmd := ParseOp(body)
+	if cmd == nil {
+		return nil, fmt.Errorf("invalid frame: %q", body)
+	}
+
+	frame.OpCmd = cmd
+	frame.Rows = splitRows(cmd)
+	return frame, nil
+}
+
+func splitRows(cmd *OpCmd) (rows [][]string) {
+	body := strings.Join(cmd.Args, ",")
+	if body == "" {
+		return nil
+	}
+
+	for _, line := range strings.Split(body, "\n") {
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+
+	return rows
+}
+
+// 客户端默认允许的最大帧长度
+const DefaultClientMaxFrameLen = 64 << 20
+
+type KannaClient struct {
+	Conn        net.Conn
+	AutoAck     bool // 收到可靠帧后自动回复ack
+	MaxFrameLen int  // 超过时ReadFrame返回错误, 0为DefaultClientMaxFrameLen
+
+	reader    *bufio.Reader
+	chunks    *ChunkAssembler
+	msgId     int64
+	codec     Compressor
+	writeLock sync.Mutex
+}
+
+// addr为host:port或者socket:/path
+func DialKanna(addr string, timeout time.Duration) (*KannaClient, error) {
+	network := "tcp4"
+	if strings.HasPrefix(addr, "socket:") {
+		network, addr = "unix", addr[len("socket:"):]
+	}
+
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKannaClient(conn), nil
+}
+
+func NewKannaClient(conn net.Conn) *KannaClient {
+	return &KannaClient{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, ReadBufferSize),
+		chunks: NewChunkAssembler(),
+	}
+}
+
+func (c *KannaClient) Close() error {
+	return c.Conn.Close()
+}
+
+func (c *KannaClient) NextMsgId() string {
+	return strconv.FormatInt(atomic.AddInt64(&c.msgId, 1), 10)
+}
+
+func (c *KannaClient) SendRaw(b []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// 自动生成msgId并返回
+func (c *KannaClient) Send(op string, args ...string) (string, error) {
+	msgId := c.NextMsgId()
+	return msgId, c.SendRaw(EncodeCmd(op, msgId, args...))
+}
+
+// 发送 op{a,b} 形式的命令, 没有msgId时自动生成, 返回实际使用的msgId
+func (c *KannaClient) SendLine(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	cmd := ParseOp([]byte(line))
+	if cmd == nil || cmd.Op == "" {
+		return "", fmt.Errorf("invalid command %q, want op{arg,arg}", line)
+	}
+
+	msgId := cmd.MsgId
+	if msgId == "" {
+		msgId = c.NextMsgId()
+		line += msgId
+	}
+
+	return msgId, c.SendRaw(encodeLine(line))
+}
+
+// 协商压缩, 返回服务端选中的算法, none表示不压缩
+func (c *KannaClient) Compress(names ...string) (string, error) {
+	msgId, err := c.Send(OpCompress, names...)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		frame, err := c.ReadFrame()
+		if err != nil {
+			return "", err
+		}
+
+		if frame.Op != OpCompress || frame.MsgId != msgId {
+			continue
+		}
+
+		name := ""
+		if vals := frame.Values(); len(vals) > 0 {
+			name = vals[0]
+		}
+
+		c.codec = GetCompressor(name)
+		return name, nil
+	}
+}
+
+func (c *KannaClient) ReadFrame() (*Frame, error) {
+	head := make([]byte, PackHeadLen)
+	if _, err := io.ReadFull(c.reader, head); err != nil {
+		return nil, err
+	}
+
+	msgLen := binary.BigEndian.Uint32(head) &^ frameFlagMask
+	max := c.MaxFrameLen
+	if max <= 0 {
+		max = DefaultClientMaxFrameLen
+	}
+
+	if int(msgLen) > max {
+		return nil, fmt.Errorf("frame too large: %d", msgLen)
+	}
+
+	b := make([]byte, PackHeadLen+int(msgLen))
+	copy(b, head)
+	if _, err := io.ReadFull(c.reader, b[PackHeadLen:]); err != nil {
+		return nil, err
+	}
+
+	frame, err := DecodeFrame(b, c.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	if frame.Seq > 0 && c.AutoAck {
+		c.Send(OpAck, strconv.FormatUint(frame.Seq, 10))
+	}
+
+	return frame, nil
+}
+
+// 和ReadFrame一样, 但是会把分块回复拼成一帧再返回
+func (c *KannaClient) ReadMessage() (*Frame, error) {
+	for {
+		frame, err := c.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		frame, err = c.chunks.Add(frame)
+		if err != nil {
+			return nil, err
+		}
+
+		if frame != nil {
+			return frame, nil
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 节点之间的op, 消息体用base64编码, 收到的消息只在本地投递不再转发
+// 连接后需要先发c.hello通过共享密钥验证, 之前收到的其他消息都丢弃
+const clusterOpHello = "c.hello"   // c.hello{nodeID,node,advertiseAddr,ts,mac}
+const clusterOpBroadcast = "c.bc"  // c.bc{msg}
+const clusterOpPublish = "c.pub"   // c.pub{topic,msg}
+const clusterOpSend = "c.send"     // c.send{connID,msg}
+const clusterOpGossip = "c.gossip" // c.gossip{addr,addr...}
+
+const DefaultClusterMaxMsgLen = 4 << 20
+const DefaultClusterGossipInterval = time.Second * 5
+const DefaultClusterReconnectInterval = time.Second * 3
+
+// c.hello的时间戳和本机相差超过这个时间时拒绝, 限制重放
+const clusterHelloMaxSkew = time.Minute
+
+const clusterAuthedKey = "kanna.cluster.authed"
+
+type ClusterConfig struct {
+	NodeID        string
+	Node          int // 节点编号 0~SnowflakeMaxNode, 所有节点不能相同, 写在连接ID里, 转发的send只由这个节点投递
+	ListenAddr    string
+	ListenPort    int
+	AdvertiseAddr string   // 其他节点连接本节点的地址 host:port, 默认为实际监听的地址
+	Peers         []string // 静态配置的节点地址 host:port
+	Gossip        bool     // 节点之间交换成员列表, 自动连接新发现的节点
+	Secret        string   // 所有节点相同的共享密钥, 为空时拒绝所有节点; 连接本身不加密, 需要放在内网或隧道里
+
+	GossipInterval    time.Duration
+	ReconnectInterval time.Duration
+	MaxMsgLen         int
+}
+
+type clusterPeer struct {
+	addr string
+	conn IKannaConnBehavior
+}
+
+type Cluster struct {
+	config    ClusterConfig
+	server    *KannaServer
+	peer      *KannaServer // 节点之间的连接, 复用Kanna的帧格式
+	listener  net.Listener
+	peers     map[string]*clusterPeer
+	lock      sync.RWMutex
+	close     chan bool
+	closeOnce sync.Once
+}
+
+// 需要在Listen之前调用, 会把IDGenerator换成按Node生成的snowflake, 保证连接ID在集群里唯一
+func (c *KannaServer) EnableCluster(config ClusterConfig) (*Cluster, error) {
+	if config.Node < 0 || config.Node > SnowflakeMaxNode {
+		return nil, fmt.Errorf("cluster node %d out of range 0-%d", config.Node, SnowflakeMaxNode)
+	}
+
+	// 32位平台上snowflake ID会截断, 不同节点的连接ID可能相同
+	if strconv.IntSize < 64 {
+		return nil, fmt.Errorf("cluster needs 64-bit int for node unique conn IDs")
+	}
+
+	if c.serving() {
+		return nil, fmt.Errorf("cluster must be enabled before Listen")
+	}
+
+	if config.GossipInterval <= 0 {
+		config.GossipInterval = DefaultClusterGossipInterval
+	}
+
+	if config.ReconnectInterval <= 0 {
+		config.ReconnectInterval = DefaultClusterReconnectInterval
+	}
+
+	if config.MaxMsgLen <= 0 {
+		config.MaxMsgLen = DefaultClusterMaxMsgLen
+	}
+
+	listener, err := net.Listen("tcp4", fmt.Sprintf("%s:%d", config.ListenAddr, config.ListenPort))
+	if err != nil {
+		return nil, err
+	}
+
+	if config.AdvertiseAddr == "" {
+		config.AdvertiseAddr = listener.Addr().String()
+	}
+
+	peer := NewKananServer()
+	peer.ID = config.NodeID
+	peer.MaxMsgLen = config.MaxMsgLen
+	peer.SerialDispatch = true
+
+	cl := &Cluster{
+		config:   config,
+		server:   c,
+		peer:     peer,
+		listener: listener,
+		peers:    make(map[string]*clusterPeer),
+		close:    make(chan bool),
+	}
+
+	for _, addr := range config.Peers {
+		cl.addPeer(addr)
+	}
+
+	if config.Secret == "" {
+		log.Println("cluster secret is empty, all peers will be rejected")
+	}
+
+	c.IDGenerator = NewSnowflakeIDGenerator(config.Node)
+	c.cluster = cl
+	go peer.Serve(listener, cl.handlePeerMsg)
+	go cl.loop()
+
+	return cl, nil
+}
+
+func (cl *Cluster) GetNodeID() string {
+	return cl.config.NodeID
+}
+
+// 已知的节点地址, 不包括自己
+func (cl *Cluster) Members() (res []string) {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	for addr := range cl.peers {
+		res = append(res, addr)
+	}
+
+	return res
+}
+
+// 当前连接正常的节点数
+func (cl *Cluster) Alive() int {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	n := 0
+	for _, p := range cl.peers {
+		if p.conn != nil && !p.conn.IsClosed() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// 停止监听并断开所有节点, 可以重复调用
+func (cl *Cluster) Close() {
+	cl.closeOnce.Do(func() {
+		close(cl.close)
+		cl.listener.Close()
+		cl.peer.CloseAllConn()
+	})
+}
+
+func (cl *Cluster) addPeer(addr string) {
+	if addr == "" || addr == cl.config.AdvertiseAddr {
+		return
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if _, ok := cl.peers[addr]; !ok {
+		cl.peers[addr] = &clusterPeer{addr: addr}
+	}
+}
+
+func (cl *Cluster) loop() {
+	cl.connectPeers()
+
+	reconnect := time.NewTicker(cl.config.ReconnectInterval)
+	defer reconnect.Stop()
+
+	gossip := time.NewTicker(cl.config.GossipInterval)
+	defer gossip.Stop()
+
+	for {
+		select {
+		case <-cl.close:
+			return
+		case <-reconnect.C:
+			cl.connectPeers()
+		case <-gossip.C:
+			if cl.config.Gossip {
+				cl.sendGossip()
+			}
+		}
+	}
+}
+
+func (cl *Cluster) connectPeers() {
+	cl.lock.RLock()
+	var missing []string
+	for addr, p := range cl.peers {
+		if p.conn == nil || p.conn.IsClosed() {
+			missing = append(missing, addr)
+		}
+	}
+	cl.lock.RUnlock()
+
+	for _, addr := range missing {
+		if err := cl.dial(addr); err != nil {
+			log.Println("cluster dial err", addr, err)
+		}
+	}
+}
+
+// 每个节点只通过自己拨出去的连接发送, 收到的连接只用来接收
+func (cl *Cluster) dial(addr string) error {
+	// 连不上的节点不能拖住重连和gossip
+	conn, err := net.DialTimeout("tcp4", addr, cl.config.ReconnectInterval)
+	if err != nil {
+		return err
+	}
+
+	peerConn := NewKannaTcpConnection(cl.peer, cl.peer.nextConnID(), conn.(*net.TCPConn), cl.handlePeerMsg)
+	peerConn.Start()
+
+	node := strconv.Itoa(cl.config.Node)
+	ts := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	mac := cl.helloMAC(cl.config.NodeID, node, cl.config.AdvertiseAddr, ts)
+	peerConn.SendMsg(encodeClusterFrame(clusterOpHello, cl.config.NodeID, node, cl.config.AdvertiseAddr, ts, mac))
+
+	cl.lock.Lock()
+	if p, ok := cl.peers[addr]; ok {
+		p.conn = peerConn
+	}
+	cl.lock.Unlock()
+
+	log.Println("cluster connected", addr)
+	return nil
+}
+
+func (cl *Cluster) sendGossip() {
+	members := append([]string{cl.config.AdvertiseAddr}, cl.Members()...)
+	cl.sendPeers(encodeClusterFrame(clusterOpGossip, members...))
+}
+
+func (cl *Cluster) sendPeers(msg []byte) {
+	cl.lock.RLock()
+	var conns []IKannaConnBehavior
+	for _, p := range cl.peers {
+		if p.conn != nil && !p.conn.IsClosed() {
+			conns = append(conns, p.conn)
+		}
+	}
+	cl.lock.RUnlock()
+
+	for _, conn := range conns {
+		conn.SendMsg(msg)
+	}
+}
+
+func (cl *Cluster) forwardBroadcast(msg []byte) {
+	cl.sendPeers(encodeClusterFrame(clusterOpBroadcast, base64.StdEncoding.EncodeToString(msg)))
+}
+
+func (cl *Cluster) forwardPublish(topic string, msg []byte) {
+	cl.sendPeers(encodeClusterFrame(clusterOpPublish, base64.RawURLEncoding.EncodeToString([]byte(topic)), base64.StdEncoding.EncodeToString(msg)))
+}
+
+// 发给所有节点, 只有ID里的节点和自己相同的才投递
+func (cl *Cluster) forwardSend(id int, msg []byte) {
+	cl.sendPeers(encodeClusterFrame(clusterOpSend, strconv.Itoa(id), base64.StdEncoding.EncodeToString(msg)))
+}
+
+// ParseOp按逗号切分参数, 所以这里不用DataPack的tab分隔
+func encodeClusterFrame(op string, args ...string) []byte {
+	return encodeLine(op + "{" + strings.Join(args, ",") + "}\n")
+}
+
+func (cl *Cluster) helloMAC(nodeID, node, addr, ts string) string {
+	h := hmac.New(sha256.New, []byte(cl.config.Secret))
+	h.Write([]byte(nodeID + "\n" + node + "\n" + addr + "\n" + ts))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (cl *Cluster) checkHello(args []string) error {
+	if cl.config.Secret == "" {
+		return fmt.Errorf("cluster secret not set")
+	}
+
+	if len(args) < 5 {
+		return fmt.Errorf("missing mac")
+	}
+
+	ms, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid ts %q", args[3])
+	}
+
+	skew := time.Since(time.Unix(0, ms*int64(time.Millisecond)))
+	if skew > clusterHelloMaxSkew || skew < -clusterHelloMaxSkew {
+		return fmt.Errorf("ts skew %s", skew)
+	}
+
+	mac, err := hex.DecodeString(args[4])
+	if err != nil {
+		return fmt.Errorf("invalid mac")
+	}
+
+	expect, _ := hex.DecodeString(cl.helloMAC(args[0], args[1], args[2], args[3]))
+	if !hmac.Equal(mac, expect) {
+		return fmt.Errorf("mac mismatch")
+	}
+
+	// 节点编号相同时两边的连接ID会重复, send会投递给错误的连接
+	node, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid node %q", args[1])
+	}
+
+	if node == cl.config.Node {
+		return fmt.Errorf("node %d conflicts with local node", node)
+	}
+
+	return nil
+}
+
+func (cl *Cluster) handlePeerMsg(r *Request) {
+	cmd := ParseOp(r.GetData())
+	if cmd == nil {
+		return
+	}
+
+	conn := r.GetConnection()
+	if cmd.Op == clusterOpHello {
+		if err := cl.checkHello(cmd.Args); err != nil {
+			log.Println("cluster hello rejected", conn.GetID(), err)
+			conn.Stop()
+			return
+		}
+
+		conn.GetProps().Store(clusterAuthedKey, true)
+		cl.addPeer(cmd.Args[2])
+		return
+	}
+
+	if _, ok := conn.GetProps().Load(clusterAuthedKey); !ok {
+		log.Println("cluster drop msg from unauthenticated peer", conn.GetID(), cmd.Op)
+		return
+	}
+
+	switch cmd.Op {
+	case clusterOpGossip:
+		if cl.config.Gossip {
+			for _, addr := range cmd.Args {
+				cl.addPeer(addr)
+			}
+		}
+	case clusterOpBroadcast:
+		if len(cmd.Args) < 1 {
+			return
+		}
+
+		if msg, err := base64.StdEncoding.DecodeString(cmd.Args[0]); err == nil {
+			cl.server.broadcastLocal(msg)
+		}
+	case clusterOpPublish:
+		if len(cmd.Args) < 2 {
+			return
+		}
+
+		topic, err := base64.RawURLEncoding.DecodeString(cmd.Args[0])
+		if err != nil {
+			return
+		}
+
+		if msg, err := base64.StdEncoding.DecodeString(cmd.Args[1]); err == nil {
+			cl.server.publishLocal(string(topic), msg)
+		}
+	case clusterOpSend:
+		if len(cmd.Args) < 2 {
+			return
+		}
+
+		id, err := strconv.Atoi(cmd.Args[0])
+		if err != nil || SnowflakeNode(id) != cl.config.Node {
+			return
+		}
+
+		if msg, err := base64.StdEncoding.DecodeString(cmd.Args[1]); err == nil {
+			cl.server.sendLocal(id, msg)
+		}
+	}
+}
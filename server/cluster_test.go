@@ -0,0 +1,184 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startNode(t *testing.T, name string, node int, secret string, peers ...string) (*KannaServer, *Cluster) {
+	s := NewKananServer()
+	cl, err := s.EnableCluster(ClusterConfig{
+		NodeID:            name,
+		Node:              node,
+		ListenAddr:        "127.0.0.1",
+		Peers:             peers,
+		Secret:            secret,
+		GossipInterval:    time.Hour,
+		ReconnectInterval: time.Millisecond * 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cl.Close()
+		s.CloseAllConn()
+	})
+
+	return s, cl
+}
+
+func waitAlive(t *testing.T, cls ...*Cluster) {
+	deadline := time.Now().Add(time.Second * 3)
+	for _, cl := range cls {
+		for cl.Alive() < 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %s has no alive peer", cl.GetNodeID())
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+	}
+}
+
+// 下一帧必须是op
+func expectOp(t *testing.T, client *KannaClient, op string) {
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("waiting for %s: %v", op, err)
+	}
+
+	if frame.Op != op {
+		t.Fatalf("got %s, want %s", frame.Op, op)
+	}
+}
+
+func expectNothing(t *testing.T, client *KannaClient) {
+	client.Conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if frame, err := client.ReadFrame(); err == nil {
+		t.Fatalf("unexpected frame %s", frame.Op)
+	}
+}
+
+func TestClusterFanOut(t *testing.T) {
+	a, acl := startNode(t, "a", 1, "secret")
+	b, bcl := startNode(t, "b", 2, "secret", acl.config.AdvertiseAddr)
+	waitAlive(t, acl, bcl)
+
+	connA, ca := pipeClient(t, a, nil)
+	connB, cb := pipeClient(t, b, nil)
+	b.Subscribe(connB, "ticker")
+
+	a.Broadcast(EncodeCmd("bc", "", "1"))
+	expectOp(t, ca, "bc")
+	expectOp(t, cb, "bc")
+
+	// ca没有订阅, 下一帧直接是后面的direct
+	a.Publish("ticker", EncodeCmd("tick", "", "BTC-USDT"))
+	expectOp(t, cb, "tick")
+
+	a.SendMsg(connB.GetID(), EncodeCmd("direct", "", "to b"))
+	expectOp(t, cb, "direct")
+
+	b.SendMsg(connA.GetID(), EncodeCmd("direct", "", "to a"))
+	expectOp(t, ca, "direct")
+}
+
+// 其他节点上ID相同的连接不能收到转发的send
+func TestClusterSendOnlyOwningNode(t *testing.T) {
+	a, acl := startNode(t, "a", 1, "secret")
+	b, bcl := startNode(t, "b", 2, "secret", acl.config.AdvertiseAddr)
+	waitAlive(t, acl, bcl)
+
+	// 节点位是a的ID, 但连接在b上
+	id := NewSnowflakeIDGenerator(1).NextID()
+	b.IDGenerator = &fixedIDGenerator{id}
+	conn, cb := pipeClient(t, b, nil)
+	if conn.GetID() != id {
+		t.Fatalf("conn id %d, want %d", conn.GetID(), id)
+	}
+
+	a.SendMsg(id, EncodeCmd("direct", "", "secret data"))
+	expectNothing(t, cb)
+}
+
+func TestClusterRejectsWrongSecret(t *testing.T) {
+	a, acl := startNode(t, "a", 1, "secret")
+	b, _ := startNode(t, "b", 2, "other", acl.config.AdvertiseAddr)
+	_, ca := pipeClient(t, a, nil)
+
+	// 等b连上并被拒绝几次
+	time.Sleep(time.Millisecond * 100)
+	if members := acl.Members(); len(members) != 0 {
+		t.Fatalf("a accepted peers %v", members)
+	}
+
+	b.Broadcast(EncodeCmd("bc", "", "1"))
+	expectNothing(t, ca)
+}
+
+func TestClusterCheckHello(t *testing.T) {
+	cl := &Cluster{config: ClusterConfig{Node: 1, Secret: "secret"}}
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	old := strconv.FormatInt(time.Now().Add(-clusterHelloMaxSkew*2).UnixNano()/int64(time.Millisecond), 10)
+	hello := func(node, ts string) []string {
+		return []string{"b", node, "127.0.0.1:7001", ts, cl.helloMAC("b", node, "127.0.0.1:7001", ts)}
+	}
+
+	badMAC := hello("2", now)
+	badMAC[2] = "127.0.0.1:7002"
+
+	cases := []struct {
+		name string
+		args []string
+		ok   bool
+	}{
+		{"valid", hello("2", now), true},
+		{"missing mac", hello("2", now)[:4], false},
+		{"tampered addr", badMAC, false},
+		{"stale ts", hello("2", old), false},
+		{"invalid ts", hello("2", "x"), false},
+		{"invalid node", hello("x", now), false},
+		{"same node", hello("1", now), false},
+	}
+
+	for _, c := range cases {
+		if err := cl.checkHello(c.args); (err == nil) != c.ok {
+			t.Errorf("%s: got err %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+
+	// 没有配置密钥时拒绝所有节点
+	empty := &Cluster{config: ClusterConfig{Node: 1}}
+	if err := empty.checkHello(hello("2", now)); err == nil {
+		t.Error("empty secret accepted hello")
+	}
+}
+
+func TestClusterClose(t *testing.T) {
+	_, cl := startNode(t, "a", 1, "secret")
+	cl.Close()
+	cl.Close()
+
+	if conn, err := net.DialTimeout("tcp4", cl.config.AdvertiseAddr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("peer listener still accepting after Close")
+	}
+}
+
+func TestEnableClusterErrors(t *testing.T) {
+	s := NewKananServer()
+	if _, err := s.EnableCluster(ClusterConfig{Node: SnowflakeMaxNode + 1, ListenAddr: "127.0.0.1"}); err == nil {
+		t.Error("node out of range accepted")
+	}
+
+	// 已经有连接时ID不是按节点生成的
+	_, peers := pipeConns(t, s, 1, nil)
+	defer peers[0].Close()
+	defer s.CloseAllConn()
+
+	if _, err := s.EnableCluster(ClusterConfig{Node: 1, ListenAddr: "127.0.0.1"}); err == nil {
+		t.Error("EnableCluster after serving accepted")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var idleTransports = []string{"goroutine", "epoll"}
+
+// 接受opts.conns个空闲连接, 统计每个连接增加的堆, 栈和协程
+// 客户端的连接也在同一个进程里, 两种方式的这部分开销相同
+// 同一个进程里先测的方式关闭后还会留下内存和协程, 所以每种方式在单独的子进程里测
+func runIdle(opts *options) error {
+	fmt.Printf("%-10s %8s %12s %12s %12s\n", "transport", "conns", "heap/conn", "stack/conn", "goroutines")
+	if opts.transport != "" {
+		return idleOnce(opts, opts.transport)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range idleTransports {
+		cmd := exec.Command(exe, "-conns", strconv.Itoa(opts.conns), "-timeout", opts.timeout.String(), "-transport", name, "idle")
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		// 子进程也会打印表头, 连接关闭时server包还会往stdout打日志, 只取结果行
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, name+" ") {
+				fmt.Println(line)
+			}
+		}
+	}
+
+	return nil
+}
+
+func memSnapshot() (heap, stack uint64, goroutines int) {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return m.HeapInuse, m.StackInuse, runtime.NumGoroutine()
+}
+
+func idleOnce(opts *options, name string) error {
+	if name != "goroutine" && name != "epoll" {
+		return fmt.Errorf("unknown transport %q", name)
+	}
+
+	heap0, stack0, g0 := memSnapshot()
+
+	s, listener, err := startEmbedded(name == "epoll")
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	var clients []net.Conn
+	defer func() {
+		listener.Close()
+		for _, c := range clients {
+			c.Close()
+		}
+		s.CloseAllConn()
+		s.CloseEventLoops()
+	}()
+
+	addr := listener.Addr().String()
+	for i := 0; i < opts.conns; i++ {
+		c, err := net.DialTimeout("tcp4", addr, opts.timeout)
+		if err != nil {
+			return fmt.Errorf("%s dial %d: %v", name, i, err)
+		}
+		clients = append(clients, c)
+	}
+
+	deadline := time.Now().Add(opts.timeout)
+	for len(s.GetConns()) < opts.conns {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: only %d of %d conns accepted", name, len(s.GetConns()), opts.conns)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	heap1, stack1, g1 := memSnapshot()
+	n := int64(opts.conns)
+	fmt.Printf("%-10s %8d %12s %12s %12d\n", name, opts.conns,
+		byteSize((int64(heap1)-int64(heap0))/n), byteSize((int64(stack1)-int64(stack0))/n), g1-g0)
+
+	return nil
+}
+
+func byteSize(b int64) string {
+	if b < 1024 && b > -1024 {
+		return fmt.Sprintf("%dB", b)
+	}
+
+	return fmt.Sprintf("%.1fKB", float64(b)/1024)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kdays/kanna/server"
+)
+
+type recorder struct {
+	latencies []time.Duration
+	errors    int64
+	lock      sync.Mutex
+}
+
+func (r *recorder) add(d time.Duration) {
+	r.lock.Lock()
+	r.latencies = append(r.latencies, d)
+	r.lock.Unlock()
+}
+
+func (r *recorder) print(name string, elapsed time.Duration, sent int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	lat := r.latencies
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+
+	fmt.Printf("%s: sent %d, received %d, errors %d in %s\n", name, sent, len(lat), atomic.LoadInt64(&r.errors), elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput: %.0f/s\n", float64(len(lat))/elapsed.Seconds())
+	if len(lat) == 0 {
+		return
+	}
+
+	fmt.Printf("latency: p50 %s  p90 %s  p99 %s  p99.9 %s  max %s\n",
+		percentile(lat, 0.5), percentile(lat, 0.9), percentile(lat, 0.99), percentile(lat, 0.999), lat[len(lat)-1])
+}
+
+// lat需要已经排好序
+func percentile(lat []time.Duration, p float64) time.Duration {
+	i := int(float64(len(lat)-1) * p)
+	return lat[i].Round(time.Microsecond)
+}
+
+func dialAll(opts *options) ([]*server.KannaClient, error) {
+	var clients []*server.KannaClient
+	for i := 0; i < opts.conns; i++ {
+		client, err := server.DialKanna(opts.addr, opts.timeout)
+		if err != nil {
+			for _, c := range clients {
+				c.Close()
+			}
+			return nil, fmt.Errorf("dial %d: %v", i, err)
+		}
+		client.AutoAck = true
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// 每个连接一个发送协程和一个读取协程, 按msgId匹配回复
+func runRPC(opts *options) error {
+	cmd := server.ParseOp([]byte(opts.line))
+	if cmd == nil || cmd.Op == "" {
+		return fmt.Errorf("invalid command %q, want op{arg,arg}", opts.line)
+	}
+
+	clients, err := dialAll(opts)
+	if err != nil {
+		return err
+	}
+
+	rec := &recorder{}
+	var sent int64
+	deadline := time.Now().Add(opts.duration)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *server.KannaClient) {
+			defer wg.Done()
+			defer client.Close()
+			n := rpcConn(client, cmd, opts, deadline, rec)
+			atomic.AddInt64(&sent, n)
+		}(client)
+	}
+	wg.Wait()
+
+	rec.print("rpc "+cmd.Op, time.Since(start), sent)
+	return nil
+}
+
+func rpcConn(client *server.KannaClient, cmd *server.OpCmd, opts *options, deadline time.Time, rec *recorder) int64 {
+	var pending sync.Map // msgId -> time.Time
+	replied := make(chan bool, 1)
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+		for {
+			client.Conn.SetReadDeadline(time.Now().Add(opts.timeout))
+			frame, err := client.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if v, ok := pending.Load(frame.MsgId); ok {
+				pending.Delete(frame.MsgId)
+				rec.add(time.Since(v.(time.Time)))
+				select {
+				case replied <- true:
+				default:
+				}
+			}
+		}
+	}()
+
+	var interval time.Duration
+	if opts.rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(opts.conns) / opts.rate)
+	}
+
+	var sent int64
+	next := time.Now()
+	for time.Now().Before(deadline) {
+		msgId := client.NextMsgId()
+		pending.Store(msgId, time.Now())
+		if err := client.SendRaw(server.EncodeCmd(cmd.Op, msgId, cmd.Args...)); err != nil {
+			atomic.AddInt64(&rec.errors, 1)
+			break
+		}
+		sent++
+
+		if interval > 0 {
+			next = next.Add(interval)
+			time.Sleep(time.Until(next))
+			continue
+		}
+
+		select {
+		case <-replied:
+		case <-done:
+			return sent
+		case <-time.After(opts.timeout):
+			atomic.AddInt64(&rec.errors, 1)
+		}
+	}
+
+	// 等待最后的回复
+	waitUntil := time.Now().Add(opts.timeout)
+	for time.Now().Before(waitUntil) && syncMapLen(&pending) > 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	lost := int64(syncMapLen(&pending))
+	atomic.AddInt64(&rec.errors, lost)
+	return sent
+}
+
+func syncMapLen(m *sync.Map) int {
+	n := 0
+	m.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+
+	return n
+}
+
+// 一个连接按rate触发广播, 所有连接统计收到的广播帧, 第一列为发送时的纳秒时间戳
+func runBroadcast(opts *options) error {
+	clients, err := dialAll(opts)
+	if err != nil {
+		return err
+	}
+
+	trigger, err := server.DialKanna(opts.addr, opts.timeout)
+	if err != nil {
+		return err
+	}
+	defer trigger.Close()
+
+	rate := opts.rate
+	if rate <= 0 {
+		rate = 10
+	}
+
+	rec := &recorder{}
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *server.KannaClient) {
+			defer wg.Done()
+			for {
+				client.Conn.SetReadDeadline(time.Now().Add(opts.timeout))
+				frame, err := client.ReadMessage()
+				if err != nil {
+					return
+				}
+
+				if frame.Op != opBroadcast {
+					continue
+				}
+
+				vals := frame.Values()
+				if len(vals) == 0 {
+					continue
+				}
+
+				if ts, err := strconv.ParseInt(vals[0], 10, 64); err == nil {
+					rec.add(time.Since(time.Unix(0, ts)))
+				}
+			}
+		}(client)
+	}
+
+	var sent int64
+	start := time.Now()
+	deadline := start.Add(opts.duration)
+	interval := time.Duration(float64(time.Second) / rate)
+	size := strconv.Itoa(opts.size)
+	for next := start; time.Now().Before(deadline); next = next.Add(interval) {
+		time.Sleep(time.Until(next))
+		if _, err := trigger.Send(opBroadcast, strconv.FormatInt(time.Now().UnixNano(), 10), size); err != nil {
+			return err
+		}
+		sent++
+	}
+	elapsed := time.Since(start)
+
+	// 读取协程在超时后退出
+	time.Sleep(opts.timeout / 2)
+	for _, client := range clients {
+		client.Close()
+	}
+	wg.Wait()
+
+	rec.print(fmt.Sprintf("broadcast x%d conns", len(clients)), elapsed, sent*int64(len(clients)))
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kdays/kanna/server"
+)
+
+const usage = `kannabench [flags] [rpc|broadcast|idle]
+
+  kannabench -addr 127.0.0.1:9000 -conns 100 -rate 5000 rpc 'order{btc,1}'
+                                  N个连接按总速率发送命令, 统计回复延迟
+  kannabench -embed -conns 500 -rate 20 broadcast
+                                  触发广播, 统计所有连接收到的帧数和延迟
+  kannabench -conns 10000 idle     分别用读写协程和epoll接受N个空闲连接, 对比每个连接的内存和协程数
+                                  每种方式在单独的子进程里测量, 指定-transport时只在当前进程测这一种
+
+-embed 启动一个进程内的服务端, -transport epoll 时用ServeEventLoop接受连接, 回显所有命令, bench.bc{ts,size} 广播一个size字节的帧
+不用-embed时, broadcast模式需要服务端把 bench.bc{ts,size} 的第一个参数原样放在广播帧的第一列
+Pack, ParseOp, Broadcast, 读写的基准在server包里: go test -run XXX -bench . -benchmem
+
+`
+
+const opBroadcast = "bench.bc"
+
+type options struct {
+	addr      string
+	conns     int
+	rate      float64
+	duration  time.Duration
+	timeout   time.Duration
+	size      int
+	line      string
+	epoll     bool
+	transport string // 命令行指定的-transport, 没有指定时为空
+}
+
+func main() {
+	opts := &options{}
+	flag.StringVar(&opts.addr, "addr", "127.0.0.1:9000", "服务端地址, host:port 或 socket:/path")
+	flag.IntVar(&opts.conns, "conns", 10, "连接数")
+	flag.Float64Var(&opts.rate, "rate", 0, "每秒发送的总数, 0为每个连接收到回复后立刻发下一条")
+	flag.DurationVar(&opts.duration, "duration", time.Second*10, "压测时间")
+	flag.DurationVar(&opts.timeout, "timeout", time.Second*5, "连接和等待回复的超时时间")
+	flag.IntVar(&opts.size, "size", 64, "broadcast模式每个广播帧的大小")
+	embed := flag.Bool("embed", false, "启动进程内的服务端")
+	transport := flag.String("transport", "goroutine", "进程内服务端的传输方式, goroutine或epoll")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	opts.epoll = *transport == "epoll"
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "transport" {
+			opts.transport = *transport
+		}
+	})
+
+	mode := "rpc"
+	args := flag.Args()
+	if len(args) > 0 {
+		mode, args = args[0], args[1:]
+	}
+
+	opts.line = "ping{}"
+	if len(args) > 0 {
+		opts.line = strings.Join(args, " ")
+	}
+
+	// 进程内的服务端每个连接都会打日志, 会淹没结果
+	if *embed || mode == "idle" {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if *embed && mode != "idle" {
+		_, listener, err := startEmbedded(opts.epoll)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "embed server err:", err)
+			os.Exit(1)
+		}
+		opts.addr = listener.Addr().String()
+	}
+
+	var err error
+	switch mode {
+	case "rpc":
+		err = runRPC(opts)
+	case "broadcast":
+		err = runBroadcast(opts)
+	case "idle":
+		err = runIdle(opts)
+	default:
+		err = fmt.Errorf("unknown mode %q", mode)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func startEmbedded(epoll bool) (*server.KannaServer, net.Listener, error) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := server.NewKananServer()
+	s.MaxMsgLen = 1 << 20
+	handler := func(r *server.Request) {
+		benchHandler(s, r)
+	}
+
+	if epoll {
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- s.ServeEventLoop(listener, handler)
+		}()
+
+		// 不支持epoll时ServeEventLoop立刻返回
+		select {
+		case err := <-errChan:
+			listener.Close()
+			return nil, nil, err
+		case <-time.After(time.Millisecond * 100):
+		}
+	} else {
+		go s.Serve(listener, handler)
+	}
+
+	return s, listener, nil
+}
+
+func benchHandler(s *server.KannaServer, r *server.Request) {
+	cmd := server.ParseOp(r.GetData())
+	if cmd == nil {
+		return
+	}
+
+	if cmd.Op == opBroadcast {
+		args := append(cmd.Args, "", "")
+		size := 0
+		fmt.Sscan(args[1], &size)
+
+		pack := server.NewDataPack(opBroadcast)
+		pack.PushData(args[0], strings.Repeat("x", size))
+		s.Broadcast(pack.Pack())
+		return
+	}
+
+	pack := server.NewDataPack(cmd.Op)
+	pack.SetMsgId(cmd.MsgId)
+	vals := make([]interface{}, len(cmd.Args))
+	for k, v := range cmd.Args {
+		vals[k] = v
+	}
+	pack.PushData(vals...)
+	r.GetConnection().SendMsg(pack.Pack())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdays/kanna/server"
+)
+
+const usage = `kannactl [flags] [command...]
+
+  kannactl -addr 127.0.0.1:9000                       交互模式
+  kannactl -addr 127.0.0.1:9000 'order{1,2}' 'ping{}' 依次发送并等待回复后退出
+  kannactl -addr socket:/tmp/kanna.sock watch 'sub{ticker}'
+                                                      发送命令后持续打印收到的推送
+
+命令格式为 op{arg,arg}, 没有msgId时自动生成
+
+`
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9000", "服务端地址, host:port 或 socket:/path")
+	timeout := flag.Duration("timeout", time.Second*5, "连接和等待回复的超时时间")
+	compress := flag.String("compress", "", "协商压缩算法, 如 snappy,deflate")
+	raw := flag.Bool("raw", false, "不格式化, 直接输出收到的帧")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	client, err := server.DialKanna(*addr, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "connect err:", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+	client.AutoAck = true
+
+	if *compress != "" {
+		name, err := client.Compress(strings.Split(*compress, ",")...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "compress err:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "compress:", name)
+	}
+
+	p := &printer{out: os.Stdout, raw: *raw}
+	args := flag.Args()
+
+	switch {
+	case len(args) > 0 && args[0] == "watch":
+		err = watch(client, p, args[1:])
+	case len(args) > 0:
+		err = oneShot(client, p, args, *timeout)
+	default:
+		err = repl(client, p, os.Stdin, *timeout)
+	}
+
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// 每条命令等到对应msgId的回复再发下一条, 中间的推送也会打印出来
+func oneShot(client *server.KannaClient, p *printer, lines []string, timeout time.Duration) error {
+	for _, line := range lines {
+		msgId, err := client.SendLine(line)
+		if err != nil {
+			return err
+		}
+
+		for {
+			client.Conn.SetReadDeadline(time.Now().Add(timeout))
+			frame, err := client.ReadMessage()
+			if err != nil {
+				return fmt.Errorf("wait reply of %s: %v", line, err)
+			}
+
+			p.print(frame)
+			if frame.MsgId == msgId {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func watch(client *server.KannaClient, p *printer, lines []string) error {
+	for _, line := range lines {
+		if _, err := client.SendLine(line); err != nil {
+			return err
+		}
+	}
+
+	for {
+		frame, err := client.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		p.print(frame)
+	}
+}
+
+func repl(client *server.KannaClient, p *printer, in io.Reader, timeout time.Duration) error {
+	var pending sync.Map
+	replied := make(chan bool, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			frame, err := client.ReadMessage()
+			if err != nil {
+				errChan <- err
+				return
+			}
+
+			p.print(frame)
+			if _, ok := pending.Load(frame.MsgId); ok {
+				pending.Delete(frame.MsgId)
+				select {
+				case replied <- true:
+				default:
+				}
+			}
+		}
+	}()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	p.prompt()
+	for {
+		select {
+		case err := <-errChan:
+			return err
+		case line, ok := <-lines:
+			if !ok {
+				// 输入结束后等待还没收到的回复, 方便用管道喂命令
+				return waitPending(&pending, replied, errChan, timeout)
+			}
+
+			line = strings.TrimSpace(line)
+			switch line {
+			case "":
+			case "quit", "exit":
+				return nil
+			default:
+				// 先登记msgId再发送, 避免回复比登记先到
+				cmd := server.ParseOp([]byte(line))
+				if cmd != nil && cmd.MsgId == "" {
+					cmd.MsgId = client.NextMsgId()
+					line += cmd.MsgId
+				}
+
+				if cmd != nil {
+					pending.Store(cmd.MsgId, true)
+				}
+
+				if msgId, err := client.SendLine(line); err != nil {
+					if cmd != nil {
+						pending.Delete(cmd.MsgId)
+					}
+					p.errorf("%v", err)
+				} else {
+					p.sent(msgId)
+				}
+			}
+
+			p.prompt()
+		}
+	}
+}
+
+func waitPending(pending *sync.Map, replied chan bool, errChan chan error, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		empty := true
+		pending.Range(func(key, value interface{}) bool {
+			empty = false
+			return false
+		})
+
+		if empty {
+			return nil
+		}
+
+		select {
+		case <-replied:
+		case err := <-errChan:
+			return err
+		case <-deadline:
+			return fmt.Errorf("timeout waiting for replies")
+		}
+	}
+}
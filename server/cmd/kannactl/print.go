@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/kdays/kanna/server"
+)
+
+type printer struct {
+	out  io.Writer
+	raw  bool
+	lock sync.Mutex
+}
+
+func (p *printer) prompt() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fmt.Fprint(p.out, "kanna> ")
+}
+
+func (p *printer) sent(msgId string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fmt.Fprintf(p.out, "-> msgId=%s\n", msgId)
+}
+
+func (p *printer) errorf(format string, args ...interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fmt.Fprintf(p.out, "error: "+format+"\n", args...)
+}
+
+func (p *printer) print(frame *server.Frame) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.raw {
+		fmt.Fprintf(p.out, "%q\n", frame.Raw)
+		return
+	}
+
+	head := "<- " + frame.Op
+	if frame.MsgId != "" {
+		head += " msgId=" + frame.MsgId
+	}
+	if frame.Seq > 0 {
+		head += fmt.Sprintf(" seq=%d", frame.Seq)
+	}
+	if len(frame.Rows) > 1 {
+		head += fmt.Sprintf(" rows=%d", len(frame.Rows))
+	}
+	fmt.Fprintln(p.out, "\r"+head)
+
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	for k, row := range frame.Rows {
+		if len(frame.Rows) > 1 {
+			fmt.Fprintf(w, "   %d\t%s\n", k+1, strings.Join(row, "\t"))
+		} else {
+			fmt.Fprintf(w, "   %s\n", strings.Join(row, "\t"))
+		}
+	}
+	w.Flush()
+}
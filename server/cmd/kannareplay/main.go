@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kdays/kanna/server"
+)
+
+const usage = `kannareplay [flags] capture [capture...]
+
+  kannareplay -dump kanna.cap.2 kanna.cap.1 kanna.cap    按时间顺序打印抓包内容
+  kannareplay -addr 127.0.0.1:9000 -speed 10 kanna.cap   按10倍速把客户端的请求重放到服务端
+
+轮转出来的文件越旧编号越大, 需要按从旧到新的顺序传入
+
+`
+
+var dirNames = map[int]string{
+	server.CaptureIn:    "<-",
+	server.CaptureOut:   "->",
+	server.CaptureOpen:  "open",
+	server.CaptureClose: "close",
+}
+
+func main() {
+	addr := flag.String("addr", "", "重放到的服务端地址, host:port 或 socket:/path")
+	speed := flag.Float64("speed", 1, "倍速, 0为不等待")
+	dump := flag.Bool("dump", false, "只打印抓包内容")
+	verbose := flag.Bool("v", false, "重放时打印服务端的回复")
+	wait := flag.Duration("wait", time.Second, "重放结束后等待回复的时间")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || (*addr == "" && !*dump) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	if *dump {
+		err = server.ReplayCapture(flag.Args(), 0, printRecord)
+	} else {
+		err = replay(flag.Args(), *addr, *speed, *verbose, *wait)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func printRecord(rec *server.CaptureRecord) error {
+	data := rec.Data
+	if rec.Dir == server.CaptureOut && len(data) >= server.PackHeadLen {
+		data = data[server.PackHeadLen:]
+	}
+
+	fmt.Printf("%s %6d %-5s %q\n", rec.Time.Format("15:04:05.000000"), rec.ConnID, dirNames[rec.Dir], data)
+	return nil
+}
+
+// 每个原始连接开一个客户端连接, 只重放客户端发来的帧
+func replay(paths []string, addr string, speed float64, verbose bool, wait time.Duration) error {
+	clients := make(map[int]*server.KannaClient)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+
+	getClient := func(id int) (*server.KannaClient, error) {
+		if client, ok := clients[id]; ok {
+			return client, nil
+		}
+
+		client, err := server.DialKanna(addr, time.Second*5)
+		if err != nil {
+			return nil, err
+		}
+
+		client.AutoAck = true
+		clients[id] = client
+		go drain(id, client, verbose)
+
+		return client, nil
+	}
+
+	sent := 0
+	err := server.ReplayCapture(paths, speed, func(rec *server.CaptureRecord) error {
+		switch rec.Dir {
+		case server.CaptureOpen:
+			_, err := getClient(rec.ConnID)
+			return err
+		case server.CaptureIn:
+			client, err := getClient(rec.ConnID)
+			if err != nil {
+				return err
+			}
+
+			sent++
+			return client.SendRaw(server.EncodeFrame(rec.Data))
+		case server.CaptureClose:
+			if client, ok := clients[rec.ConnID]; ok {
+				client.Close()
+				delete(clients, rec.ConnID)
+			}
+		}
+
+		return nil
+	})
+
+	time.Sleep(wait)
+	fmt.Fprintf(os.Stderr, "replayed %d frames\n", sent)
+	return err
+}
+
+func drain(id int, client *server.KannaClient, verbose bool) {
+	for {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		if verbose {
+			fmt.Printf("%6d -> %q\n", id, frame.Raw[server.PackHeadLen:])
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// 压缩协商的op, 客户端发送 compress{deflate,snappy}msgId, 服务端回复选中的算法, 需要开启EnableCompression
+const OpCompress = "compress"
+
+// 包头长度的最高位表示该帧已压缩, 未协商的连接永远不会设置
+const FrameFlagCompressed uint32 = 1 << 31
+
+// 小于该大小的帧不压缩
+const DefaultCompressThreshold = 256
+
+// 解压后的最大长度, 防止压缩炸弹
+const MaxDecompressLen = 1 << 20
+
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var compressors = map[string]Compressor{}
+var compressorOrder []string
+var compressorLock sync.RWMutex
+
+// 按注册顺序决定优先级
+func RegisterCompressor(c Compressor) {
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+
+	name := strings.ToLower(c.Name())
+	if _, ok := compressors[name]; !ok {
+		compressorOrder = append(compressorOrder, name)
+	}
+	compressors[name] = c
+}
+
+func GetCompressor(name string) Compressor {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+
+	return compressors[strings.ToLower(name)]
+}
+
+// 从客户端提供的列表中选择服务端优先级最高的算法
+func selectCompressor(offers []string) Compressor {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+
+	for _, name := range compressorOrder {
+		for _, offer := range offers {
+			if strings.ToLower(strings.TrimSpace(offer)) == name {
+				return compressors[name]
+			}
+		}
+	}
+
+	return nil
+}
+
+type deflateCompressor struct {
+	writers sync.Pool
+}
+
+func (d *deflateCompressor) Name() string {
+	return "deflate"
+}
+
+func (d *deflateCompressor) Compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+
+	w, _ := d.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer d.writers.Put(w)
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (d *deflateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	res, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressLen+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) > MaxDecompressLen {
+		return nil, fmt.Errorf("decompressed data too large")
+	}
+
+	return res, nil
+}
+
+type snappyCompressor struct{}
+
+func (s *snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (s *snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (s *snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > MaxDecompressLen {
+		return nil, fmt.Errorf("decompressed data too large")
+	}
+
+	return snappy.Decode(nil, data)
+}
+
+func init() {
+	RegisterCompressor(&deflateCompressor{})
+	RegisterCompressor(&snappyCompressor{})
+}
+
+// 对已经Pack好的帧按需压缩, 不是单个完整帧的数据原样返回
+func compressFrame(codec Compressor, threshold int, data []byte) []byte {
+	if codec == nil || len(data) < PackHeadLen {
+		return data
+	}
+
+	msgLen := binary.BigEndian.Uint32(data[:PackHeadLen])
+	bodyLen := int(msgLen &^ frameFlagMask)
+	if msgLen&FrameFlagCompressed != 0 || bodyLen != len(data)-PackHeadLen || bodyLen < threshold {
+		return data
+	}
+
+	compressed, err := codec.Compress(data[PackHeadLen:])
+	if err != nil || len(compressed) >= bodyLen {
+		return data
+	}
+
+	// 保留其他标记位
+	res := make([]byte, PackHeadLen+len(compressed))
+	binary.BigEndian.PutUint32(res, uint32(len(compressed))|FrameFlagCompressed|msgLen&frameFlagMask)
+	copy(res[PackHeadLen:], compressed)
+
+	return res
+}
+
+func (c *sKannaConnection) handleCompressHandshake(conn IKannaConnBehavior, cmd *OpCmd) {
+	reply := NewDataPack(OpCompress)
+	reply.SetMsgId(cmd.MsgId)
+
+	codec := selectCompressor(cmd.Args)
+	if codec == nil {
+		reply.PushData("none")
+	} else {
+		reply.PushData(codec.Name())
+	}
+
+	// 回复本身不压缩, 之后的帧才按协商结果处理
+	conn.SendMsg(reply.Pack())
+	c.setCodec(codec)
+}
+
+func (c *sKannaConnection) setCodec(codec Compressor) {
+	c.codecLock.Lock()
+	defer c.codecLock.Unlock()
+
+	c.codec = codec
+}
+
+func (c *sKannaConnection) getCodec() Compressor {
+	c.codecLock.RLock()
+	defer c.codecLock.RUnlock()
+
+	return c.codec
+}
+
+func (c *sKannaConnection) compressThreshold() int {
+	return c.Server.live().compressThreshold
+}
+
+// 读到的帧如果带压缩标记则解压, 解压后同样不能超过maxMsgLen
+func (c *sKannaConnection) decodeFrame(msgLen uint32, data []byte) ([]byte, error) {
+	if msgLen&FrameFlagCompressed == 0 {
+		return data, nil
+	}
+
+	codec := c.getCodec()
+	if codec == nil {
+		return nil, fmt.Errorf("compressed frame without negotiation")
+	}
+
+	res, err := codec.Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if max := c.Server.maxMsgLen(); len(res) > max {
+		return nil, fmt.Errorf("decompressed message too large: %d > %d", len(res), max)
+	}
+
+	return res, nil
+}
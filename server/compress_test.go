@@ -0,0 +1,101 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 默认不拦截compress, 和其他op一样交给MsgHandler
+func TestCompressDisabledByDefault(t *testing.T) {
+	s := NewKananServer()
+
+	ops := make(chan string, 1)
+	_, client := pipeClient(t, s, func(r *Request) {
+		if cmd := ParseOp(r.GetData()); cmd != nil {
+			ops <- cmd.Op
+		}
+	})
+
+	if _, err := client.Send(OpCompress, "snappy"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case op := <-ops:
+		if op != OpCompress {
+			t.Fatalf("handler got %q, want %q", op, OpCompress)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("compress not passed to MsgHandler")
+	}
+}
+
+func TestCompressEnabled(t *testing.T) {
+	s := NewKananServer()
+	s.EnableCompression = true
+
+	// 握手在读协程里处理完才会读下一帧, 这里的回复一定在协商之后
+	_, client := pipeClient(t, s, func(r *Request) {
+		r.GetConnection().SendMsg(EncodeCmd("order", "", strings.Repeat("BTC-USDT,43210.5,", 20)))
+	})
+	name, err := client.Compress("snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "snappy" {
+		t.Fatalf("got codec %q, want snappy", name)
+	}
+
+	if _, err := client.Send("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame.Flags&FrameFlagCompressed == 0 || frame.Op != "order" {
+		t.Fatalf("got %+v, want compressed order frame", frame)
+	}
+}
+
+// 压缩后很小但解压后超过MaxMsgLen的帧, 不交给handler并断开连接
+func TestDecompressedTooLarge(t *testing.T) {
+	s := NewKananServer()
+	s.EnableCompression = true
+	s.MaxMsgLen = 64
+
+	handled := make(chan string, 1)
+	conn, client := pipeClient(t, s, func(r *Request) {
+		handled <- string(r.GetData())
+	})
+	if _, err := client.Compress("snappy"); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := compressFrame(GetCompressor("snappy"), 0, EncodeCmd("big", "1", strings.Repeat("a", 500)))
+	if len(frame)-PackHeadLen > s.MaxMsgLen {
+		t.Fatalf("compressed frame %d bytes, want at most %d", len(frame)-PackHeadLen, s.MaxMsgLen)
+	}
+
+	if err := client.SendRaw(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !conn.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("conn not closed after oversized frame")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case data := <-handled:
+		t.Fatalf("handler got %d bytes", len(data))
+	default:
+	}
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 管理用的重新加载配置op, 需要自己挂到MsgHandler上并做好权限校验, 回复 reload{ok|fail,message} 和需要重启才能生效的配置
+const OpReload = "reload"
+
+// 支持 "30s" 这种写法, 数字为毫秒
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	if ms, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+		*d = Duration(time.Duration(ms) * time.Millisecond)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// 配置文件的内容, 字段为0时使用默认值
+// LoadServerConfig读出来的只应用文件里写了的字段, 没有写的保持当前值, 直接构造的全部应用
+type ServerConfig struct {
+	// 可以热更新
+	MaxMsgLen         int      `json:"max_msg_len"`
+	AllowTelnet       bool     `json:"allow_telnet"` // 只对新连接生效
+	EnableCompression bool     `json:"enable_compression"`
+	CompressThreshold int      `json:"compress_threshold"`
+	SessionGrace      Duration `json:"session_grace"`
+	SessionBufferSize int      `json:"session_buffer_size"`
+	WriteBatchSize    int      `json:"write_batch_size"`
+	WriteLatency      Duration `json:"write_latency"`
+	MaxConns          int      `json:"max_conns"`
+	MaxConnsPerIP     int      `json:"max_conns_per_ip"`
+	AllowCIDRs        []string `json:"allow_cidrs"`
+	DenyCIDRs         []string `json:"deny_cidrs"`
+
+	// 需要重启
+	WriteQueueSize int  `json:"write_queue_size"`
+	EnableSession  bool `json:"enable_session"`
+	EnableReliable bool `json:"enable_reliable"`
+	EnableHello    bool `json:"enable_hello"`
+	SerialDispatch bool `json:"serial_dispatch"`
+
+	present map[string]bool // 文件里出现的字段, nil为全部
+}
+
+func (cfg *ServerConfig) UnmarshalJSON(b []byte) error {
+	type plain ServerConfig
+	if err := json.Unmarshal(b, (*plain)(cfg)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	// 和encoding/json一样不区分大小写
+	cfg.present = make(map[string]bool, len(fields))
+	for name := range fields {
+		cfg.present[strings.ToLower(name)] = true
+	}
+
+	return nil
+}
+
+func (cfg *ServerConfig) has(name string) bool {
+	return cfg.present == nil || cfg.present[name]
+}
+
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &ServerConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// 应用配置, 先全部校验再一起替换, 出错时不做任何修改
+// 还没有开始服务时(WatchConfig的首次加载)所有字段都生效
+// 之后返回和当前值不同但需要重启才能生效的配置项, 这些项不会被修改
+func (c *KannaServer) ApplyConfig(cfg *ServerConfig) ([]string, error) {
+	allow, err := parseCIDRs(cfg.AllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %v", err)
+	}
+
+	deny, err := parseCIDRs(cfg.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %v", err)
+	}
+
+	started := c.serving()
+
+	c.configLock.Lock()
+	if cfg.has("max_msg_len") {
+		c.MaxMsgLen = cfg.MaxMsgLen
+	}
+	if cfg.has("allow_telnet") {
+		c.AllowTelnet = cfg.AllowTelnet
+	}
+	if cfg.has("enable_compression") {
+		c.EnableCompression = cfg.EnableCompression
+	}
+	if cfg.has("compress_threshold") {
+		c.CompressThreshold = cfg.CompressThreshold
+	}
+	if cfg.has("session_grace") {
+		c.SessionGrace = time.Duration(cfg.SessionGrace)
+	}
+	if cfg.has("session_buffer_size") {
+		c.SessionBufferSize = cfg.SessionBufferSize
+	}
+	if cfg.has("write_batch_size") {
+		c.WriteBatchSize = cfg.WriteBatchSize
+	}
+	if cfg.has("write_latency") {
+		c.WriteLatency = time.Duration(cfg.WriteLatency)
+	}
+
+	var restart []string
+	restartField := func(name string, changed bool, apply func()) {
+		if !cfg.has(name) {
+			return
+		}
+
+		if !started {
+			apply()
+		} else if changed {
+			restart = append(restart, name)
+		}
+	}
+
+	restartField("write_queue_size", cfg.WriteQueueSize != c.WriteQueueSize, func() { c.WriteQueueSize = cfg.WriteQueueSize })
+	restartField("enable_session", cfg.EnableSession != c.EnableSession, func() { c.EnableSession = cfg.EnableSession })
+	restartField("enable_reliable", cfg.EnableReliable != c.EnableReliable, func() { c.EnableReliable = cfg.EnableReliable })
+	restartField("enable_hello", cfg.EnableHello != c.EnableHello, func() { c.EnableHello = cfg.EnableHello })
+	restartField("serial_dispatch", cfg.SerialDispatch != c.SerialDispatch, func() { c.SerialDispatch = cfg.SerialDispatch })
+
+	c.liveConfig.Store(c.snapshotConfig())
+
+	// admit在admission.lock里读MaxConns, 一起替换
+	c.admission.lock.Lock()
+	if cfg.has("max_conns") {
+		c.MaxConns = cfg.MaxConns
+	}
+	if cfg.has("max_conns_per_ip") {
+		c.MaxConnsPerIP = cfg.MaxConnsPerIP
+	}
+	if cfg.has("allow_cidrs") {
+		c.admission.allow = allow
+	}
+	if cfg.has("deny_cidrs") {
+		c.admission.deny = deny
+	}
+	c.admission.lock.Unlock()
+	c.configLock.Unlock()
+
+	return restart, nil
+}
+
+// 加载配置文件并在收到SIGHUP时重新加载, 需要在Listen之前调用
+func (c *KannaServer) WatchConfig(path string) error {
+	c.configLock.Lock()
+	c.configPath = path
+	c.configLock.Unlock()
+
+	if _, err := c.ReloadConfig(); err != nil {
+		return err
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			restart, err := c.ReloadConfig()
+			if err != nil {
+				log.Println("reload config err", err)
+				continue
+			}
+
+			log.Println("config reloaded", path)
+			for _, name := range restart {
+				log.Println("config", name, "changed, need restart to take effect")
+			}
+		}
+	}()
+
+	return nil
+}
+
+// 重新读取WatchConfig设置的文件
+func (c *KannaServer) ReloadConfig() ([]string, error) {
+	c.configLock.RLock()
+	path := c.configPath
+	c.configLock.RUnlock()
+
+	if path == "" {
+		return nil, fmt.Errorf("no config file, call WatchConfig first")
+	}
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ApplyConfig(cfg)
+}
+
+// 处理reload{}, 每个需要重启的配置项单独一行 restart{name}
+func (c *KannaServer) HandleReload(r *Request) {
+	cmd := ParseOp(r.GetData())
+	if cmd == nil {
+		return
+	}
+
+	pack := NewDataPack(OpReload)
+	pack.SetMsgId(cmd.MsgId)
+	pack.Multi()
+
+	restart, err := c.ReloadConfig()
+	if err != nil {
+		pack.PushData("fail", err.Error())
+		r.GetConnection().SendMsg(pack.Pack())
+		return
+	}
+
+	pack.PushData("ok", len(restart))
+	for _, name := range restart {
+		pack.PushData("restart", name)
+	}
+	r.GetConnection().SendMsg(pack.Pack())
+}
+
+// 可以热更新的配置, 已经填好默认值, ApplyConfig时整体替换
+// 每帧和每次发送都要读, 用atomic.Value避免所有连接争同一把锁
+type liveConfig struct {
+	maxMsgLen         int
+	allowTelnet       bool
+	enableCompression bool
+	compressThreshold int
+	sessionGrace      time.Duration
+	sessionBufferSize int
+	writeBatchSize    int
+	writeLatency      time.Duration
+}
+
+// 第一次读的时候从字段生成, 直接修改字段需要在Listen之前, 之后用ApplyConfig
+func (c *KannaServer) live() *liveConfig {
+	if v, ok := c.liveConfig.Load().(*liveConfig); ok {
+		return v
+	}
+
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+
+	if v, ok := c.liveConfig.Load().(*liveConfig); ok {
+		return v
+	}
+
+	v := c.snapshotConfig()
+	c.liveConfig.Store(v)
+	return v
+}
+
+// 需要持有configLock
+func (c *KannaServer) snapshotConfig() *liveConfig {
+	v := &liveConfig{
+		maxMsgLen:         c.MaxMsgLen,
+		allowTelnet:       c.AllowTelnet,
+		enableCompression: c.EnableCompression,
+		compressThreshold: c.CompressThreshold,
+		sessionGrace:      c.SessionGrace,
+		sessionBufferSize: c.SessionBufferSize,
+		writeBatchSize:    c.WriteBatchSize,
+		writeLatency:      c.WriteLatency,
+	}
+
+	if v.maxMsgLen <= 0 {
+		v.maxMsgLen = DefaultMaxMsgLen
+	}
+	if v.compressThreshold <= 0 {
+		v.compressThreshold = DefaultCompressThreshold
+	}
+	if v.sessionGrace <= 0 {
+		v.sessionGrace = DefaultSessionGrace
+	}
+	if v.sessionBufferSize <= 0 {
+		v.sessionBufferSize = DefaultSessionBufferSize
+	}
+	if v.writeBatchSize <= 0 {
+		v.writeBatchSize = DefaultWriteBatchSize
+	}
+
+	return v
+}
+
+// 有listener在accept或者有连接时, 需要重启的配置不能再改
+func (c *KannaServer) serving() bool {
+	return atomic.LoadInt32(&c.listeners) > 0 || c.ExistsConn()
+}
+
+func (c *KannaServer) allowTelnet() bool {
+	return c.live().allowTelnet
+}
+
+func (c *KannaServer) enableCompression() bool {
+	return c.live().enableCompression
+}
+
+func (c *KannaServer) writeLatency() time.Duration {
+	return c.live().writeLatency
+}
+
+func (c *KannaServer) sessionGrace() time.Duration {
+	return c.live().sessionGrace
+}
+
+func (c *KannaServer) sessionBufferSize() int {
+	return c.live().sessionBufferSize
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 首次加载时需要重启的配置也要生效, 开始服务之后只报告不修改
+func TestApplyConfigRestartFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kanna.json")
+	writeConfig(t, path, `{"enable_session":true,"write_queue_size":16,"max_msg_len":2048}`)
+
+	s := NewKananServer()
+	if err := s.WatchConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.EnableSession || s.WriteQueueSize != 16 || s.maxMsgLen() != 2048 {
+		t.Fatalf("initial load not applied: session %v queue %d maxMsgLen %d", s.EnableSession, s.WriteQueueSize, s.maxMsgLen())
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go s.Serve(l, nil)
+	for !s.serving() {
+		time.Sleep(time.Millisecond)
+	}
+
+	writeConfig(t, path, `{"write_queue_size":32,"enable_session":false,"max_msg_len":4096}`)
+	restart, err := s.ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"write_queue_size", "enable_session"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("restart = %v, want %v", restart, want)
+	}
+
+	if !s.EnableSession || s.WriteQueueSize != 16 {
+		t.Errorf("restart fields changed on reload: session %v queue %d", s.EnableSession, s.WriteQueueSize)
+	}
+
+	if s.maxMsgLen() != 4096 {
+		t.Errorf("maxMsgLen = %d after reload, want 4096", s.maxMsgLen())
+	}
+}
+
+// 重新加载时文件里没有的字段保持当前值, 不会被重置为0
+func TestReloadKeepsMissingFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kanna.json")
+	writeConfig(t, path, `{"enable_session":true,"max_conns":10,"compress_threshold":64,"deny_cidrs":["10.0.0.0/8"]}`)
+
+	s := NewKananServer()
+	if err := s.WatchConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 代码里设置的也保留
+	s.MaxConnsPerIP = 3
+
+	writeConfig(t, path, `{"max_msg_len":4096}`)
+	restart, err := s.ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(restart) != 0 {
+		t.Errorf("restart = %v, want none", restart)
+	}
+
+	if !s.EnableSession || s.MaxConns != 10 || s.MaxConnsPerIP != 3 || s.live().compressThreshold != 64 {
+		t.Errorf("fields reset on reload: session %v max_conns %d per_ip %d threshold %d",
+			s.EnableSession, s.MaxConns, s.MaxConnsPerIP, s.live().compressThreshold)
+	}
+
+	if s.maxMsgLen() != 4096 {
+		t.Errorf("maxMsgLen = %d after reload, want 4096", s.maxMsgLen())
+	}
+
+	if err := s.admit(1, "10.1.2.3"); err != ErrConnDenied {
+		t.Errorf("deny_cidrs reset on reload: admit returned %v", err)
+	}
+
+	// 写了的字段即使是0也生效
+	writeConfig(t, path, `{"max_conns":0}`)
+	if _, err := s.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.MaxConns != 0 {
+		t.Errorf("max_conns = %d, want 0", s.MaxConns)
+	}
+}
@@ -1,10 +1,19 @@
 package server
 
 import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// Request和GetData返回的数据在MsgHandler返回后会被回收复用, 需要在handler之外保留的话自己copy一份
 type MsgHandler = func(d *Request)
 
 // 读取逻辑在MsgHandler里
@@ -14,9 +23,12 @@ type IKannaConnBehavior interface {
 	IsClosed() bool
 	GetID() int
 	SendMsg(data []byte) error
+	SendReliable(data []byte) (uint64, error)
 	SetMsgHandler(h MsgHandler)
 	GetProps() *sync.Map
 	SetAllowTelnet(to bool)
+	GetSession() *Session
+	GetCapabilities() *Capabilities
 }
 
 type IRequest interface {
@@ -29,10 +41,16 @@ type Request struct {
 	msg  []byte
 }
 
+// 一般由连接创建, 主要给测试直接调用MsgHandler用
+func NewRequest(conn IKannaConnBehavior, data []byte) *Request {
+	return &Request{conn: conn, msg: data}
+}
+
 func (r *Request) GetConnection() IKannaConnBehavior {
 	return r.conn
 }
 
+// 只在MsgHandler执行期间有效
 func (r *Request) GetData() []byte {
 	return r.msg
 }
@@ -42,11 +60,28 @@ type sKannaConnection struct {
 	ID           int
 	last         int64
 	msgHandler   MsgHandler
-	isClosed     bool
+	closed       int32 // 原子读写, 1为已关闭
+	stopOnce     sync.Once
 	msgChan      chan []byte
-	ExitBuffChan chan bool
+	drained      chan struct{} // writer每写完一批通知一次, 分块回复等待发送队列时用
+	ExitBuffChan chan bool     // Stop时close, 通知writer和SendMsg
 	Props        *sync.Map
 	AllowTelnet  bool
+	stateLock    sync.RWMutex // 保护msgHandler, Props, AllowTelnet, session, caps
+	codec        Compressor
+	codecLock    sync.RWMutex
+	session      *Session
+	caps         *Capabilities
+	reliable     *reliableQueue
+	reader       *bufio.Reader
+	headBuf      [PackHeadLen]byte
+	sendSeq      uint64 // 进入发送队列的消息数, 原子读写
+	writtenSeq   uint64 // 已经写入socket的消息数, 由traceLock保护
+	pendingSpans []*Span
+	traceLock    sync.Mutex
+	pushes       map[string]*PushStream // 按msgId, Request.Stream创建
+	pushLock     sync.Mutex
+	offload      func(run func()) // 不为nil时内置op交给它执行, 不在读取的协程里调用
 }
 
 type KannaTCPConnection struct {
@@ -58,3 +93,274 @@ type KannaUnixSocketConnection struct {
 	*sKannaConnection
 	Conn *net.UnixConn
 }
+
+// 其他net.Conn, 比如net.Pipe
+type KannaNetConnection struct {
+	*sKannaConnection
+	Conn net.Conn
+}
+
+// ServeEventLoop接受的连接, 由epoll统一读取, 空闲时不占协程
+type KannaEventLoopConnection struct {
+	*sKannaConnection
+	Conn net.Conn
+
+	loop    *eventLoop
+	fd      int
+	raw     syscall.RawConn
+	pending []byte // 还不完整的帧, 只在loop协程里读写, 暂停期间由执行内置op的协程读写
+	paused  bool   // 正在执行内置op, 已经从epoll移除
+	builtin func() // 暂停时要执行的内置op
+	writing int32  // 1为有写协程在发送队列里的消息, 原子读写
+}
+
+const PackHeadLen = 4
+
+func newKannaConnection(server *KannaServer, ID int, conn net.Conn, handler MsgHandler) *sKannaConnection {
+	return &sKannaConnection{
+		Server:       server,
+		ID:           ID,
+		last:         time.Now().UnixNano(),
+		msgHandler:   handler,
+		ExitBuffChan: make(chan bool),
+		msgChan:      make(chan []byte, server.writeQueueSize()),
+		drained:      make(chan struct{}, 1),
+		AllowTelnet:  server.allowTelnet(),
+		Props:        &sync.Map{},
+		reliable:     newReliableQueue(),
+	}
+}
+
+func (c *sKannaConnection) GetID() int {
+	return c.ID
+}
+
+func (c *sKannaConnection) IsClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+func (c *sKannaConnection) SetAllowTelnet(to bool) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.AllowTelnet = to
+}
+
+func (c *sKannaConnection) allowTelnet() bool {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.AllowTelnet
+}
+
+func (c *sKannaConnection) SetMsgHandler(h MsgHandler) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.msgHandler = h
+}
+
+func (c *sKannaConnection) getMsgHandler() MsgHandler {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.msgHandler
+}
+
+func (c *sKannaConnection) GetProps() *sync.Map {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.Props
+}
+
+func (c *sKannaConnection) GetSession() *Session {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.session
+}
+
+func (c *sKannaConnection) setSession(sess *Session) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.session = sess
+	c.Props = sess.Props
+}
+
+func (c *sKannaConnection) send(conn IKannaConnBehavior, data []byte) error {
+	if c.IsClosed() {
+		return c.bufferToSession(conn, data)
+	}
+
+	if c.Server.NeedSendCount {
+		c.Server.incSendCount()
+	}
+
+	c.Server.record(CaptureOut, c.ID, data)
+	frame := compressFrame(c.getCodec(), c.compressThreshold(), data)
+
+	select {
+	case c.msgChan <- frame:
+		atomic.AddUint64(&c.sendSeq, 1)
+		return nil
+	case <-c.ExitBuffChan:
+		return c.bufferToSession(conn, data)
+	}
+}
+
+// 等待重连的session先缓存起来, 恢复后补发
+func (c *sKannaConnection) bufferToSession(conn IKannaConnBehavior, data []byte) error {
+	if sess := c.GetSession(); sess != nil && sess.buffer(conn, data) {
+		return nil
+	}
+
+	return fmt.Errorf("connection closed")
+}
+
+// 可以并发调用, 只有第一次生效, 其他调用会等到第一次执行完
+func (c *sKannaConnection) stop(conn IKannaConnBehavior, closer io.Closer) {
+	c.stopOnce.Do(func() {
+		log.Println(c.ID, " will quit")
+		atomic.StoreInt32(&c.closed, 1)
+
+		close(c.ExitBuffChan)
+		closer.Close()
+
+		c.Server.record(CaptureClose, c.ID, nil)
+		c.flushSpans()
+		c.cancelAllPushes()
+		if c.Server.OnConnEnd != nil {
+			c.Server.OnConnEnd(conn)
+		}
+
+		c.Server.RemoveConn(conn)
+		c.Server.releaseAdmission(c.ID)
+		c.Server.leaveAllGroups(conn)
+		c.release(conn)
+	})
+}
+
+func (c *sKannaConnection) start(conn IKannaConnBehavior, rw io.ReadWriter) {
+	c.Server.record(CaptureOpen, c.ID, nil)
+	c.reader = bufio.NewReaderSize(rw, ReadBufferSize)
+	go c.startWriter(conn, rw)
+
+	// 读协程启动前创建session, 否则先到的resume会被之后创建的新session覆盖
+	c.startSession(conn)
+	go c.startReader(conn)
+}
+
+func (c *sKannaConnection) startWriter(conn IKannaConnBehavior, w io.Writer) {
+	log.Println(c.ID, "Writer running")
+
+	for {
+		select {
+		case data := <-c.msgChan:
+			bufs := c.collectBatch(data)
+			n := len(bufs)
+			if _, err := bufs.WriteTo(w); err != nil {
+				log.Println("Send Data Err:", err)
+				conn.Stop()
+				return
+			}
+			c.traceWritten(n)
+			c.notifyDrained()
+
+		case <-c.ExitBuffChan:
+			return
+		}
+	}
+}
+
+func (c *sKannaConnection) startReader(conn IKannaConnBehavior) {
+	log.Println(c.ID, "Reader running")
+
+	defer conn.Stop()
+	for !c.IsClosed() {
+		if c.allowTelnet() {
+			data := make([]byte, 128)
+			size, err := c.reader.Read(data)
+			if err != nil {
+				log.Println("read msg error", err)
+				break
+			}
+
+			if size > 0 {
+				c.handleTelnet(conn, data[:size])
+			}
+		} else {
+			if _, err := io.ReadFull(c.reader, c.headBuf[:]); err != nil {
+				fmt.Println("read msg head error ", err)
+				return
+			}
+
+			readStart := time.Now()
+			msgLen := binary.BigEndian.Uint32(c.headBuf[:])
+
+			bodyLen := msgLen &^ frameFlagMask
+			if bodyLen > uint32(c.Server.maxMsgLen()) {
+				fmt.Println("message too large, auto closing", bodyLen)
+				return
+			}
+
+			if bodyLen > 0 {
+				buf := getBuffer(int(bodyLen))
+				if _, err := io.ReadFull(c.reader, *buf); err != nil {
+					putBuffer(buf)
+					fmt.Println("read msg data error ", err)
+					return
+				}
+
+				if err := c.handleFrame(conn, msgLen, buf, readStart); err != nil {
+					fmt.Println("decode msg data error ", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *sKannaConnection) handleTelnet(conn IKannaConnBehavior, data []byte) {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	c.Server.record(CaptureIn, c.ID, data)
+	c.dispatch(conn, nil, data, nil)
+}
+
+// 处理一个完整的帧, buf之后由这里负责回收, 返回error时需要关闭连接
+func (c *sKannaConnection) handleFrame(conn IKannaConnBehavior, msgLen uint32, buf *[]byte, readStart time.Time) error {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	data, err := c.decodeFrame(msgLen, *buf)
+	if msgLen&FrameFlagCompressed != 0 {
+		// 解压后是新的数据, 读缓冲可以直接回收
+		putBuffer(buf)
+		buf = nil
+	}
+
+	if err != nil {
+		putBuffer(buf)
+		return err
+	}
+
+	c.Server.record(CaptureIn, c.ID, data)
+	if c.offload != nil && c.isBuiltinFrame(data) {
+		c.offload(func() {
+			if c.handleBuiltinOp(conn, data) {
+				putBuffer(buf)
+				return
+			}
+
+			c.dispatch(conn, buf, data, c.newSpan(readStart, data))
+		})
+		return nil
+	}
+
+	if c.handleBuiltinOp(conn, data) {
+		putBuffer(buf)
+		return nil
+	}
+
+	c.dispatch(conn, buf, data, c.newSpan(readStart, data))
+	return nil
+}
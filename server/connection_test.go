@@ -0,0 +1,234 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 对端只读不处理的net.Pipe连接
+func pipeConns(t testing.TB, s *KannaServer, n int, handler MsgHandler) ([]IKannaConnBehavior, []net.Conn) {
+	var conns []IKannaConnBehavior
+	var peers []net.Conn
+	for i := 0; i < n; i++ {
+		c1, c2 := net.Pipe()
+		conn := s.ServeConn(c2, handler)
+		if conn == nil {
+			t.Fatalf("conn %d rejected", i)
+		}
+
+		go io.Copy(ioutil.Discard, c1)
+		conns = append(conns, conn)
+		peers = append(peers, c1)
+	}
+
+	return conns, peers
+}
+
+// 对端是KannaClient的net.Pipe连接, 测试结束时关闭
+func pipeClient(t *testing.T, s *KannaServer, handler MsgHandler) (IKannaConnBehavior, *KannaClient) {
+	c1, c2 := net.Pipe()
+	conn := s.ServeConn(c2, handler)
+	if conn == nil {
+		t.Fatal("conn rejected")
+	}
+
+	client := NewKannaClient(c1)
+	client.Conn.SetDeadline(time.Now().Add(time.Second * 2))
+	t.Cleanup(func() {
+		client.Close()
+		conn.Stop()
+	})
+
+	return conn, client
+}
+
+// 需要用 go test -race 跑
+func TestConnLifecycleStress(t *testing.T) {
+	s := NewKananServer()
+
+	var ended int64
+	s.OnConnEnd = func(conn IKannaConnBehavior) {
+		atomic.AddInt64(&ended, 1)
+	}
+
+	echo := func(r *Request) {
+		r.GetConnection().SendMsg(EncodeCmd("echo", "", string(r.GetData())))
+	}
+
+	const n = 50
+	conns, peers := pipeConns(t, s, n, echo)
+	msg := EncodeCmd("tick", "", "BTC-USDT", "43210.5")
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(3)
+
+		go func(conn IKannaConnBehavior) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				conn.SendMsg(msg)
+			}
+		}(conn)
+
+		// 对端同时发帧, 让读协程和handler也参与
+		go func(peer net.Conn) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := peer.Write(EncodeCmd("ping", "1")); err != nil {
+					return
+				}
+			}
+		}(peers[i])
+
+		go func(conn IKannaConnBehavior, i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i%10) * time.Millisecond)
+			conn.Stop()
+			conn.Stop()
+		}(conn, i)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			s.Broadcast(msg)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond * 5)
+		s.CloseAllConn()
+	}()
+
+	wg.Wait()
+	s.CloseAllConn()
+
+	for _, conn := range conns {
+		if !conn.IsClosed() {
+			t.Errorf("conn %d not closed", conn.GetID())
+		}
+
+		if err := conn.SendMsg(msg); err == nil {
+			t.Errorf("conn %d SendMsg after Stop returned nil", conn.GetID())
+		}
+	}
+
+	if s.ExistsConn() {
+		t.Errorf("server still has %d conns", len(s.GetConns()))
+	}
+
+	if got := atomic.LoadInt64(&ended); got != n {
+		t.Errorf("OnConnEnd called %d times, want %d", got, n)
+	}
+
+	for _, peer := range peers {
+		peer.Close()
+	}
+}
+
+// 对端关闭时读协程退出并只Stop一次
+func TestConnPeerClose(t *testing.T) {
+	s := NewKananServer()
+
+	var ended int64
+	s.OnConnEnd = func(conn IKannaConnBehavior) {
+		atomic.AddInt64(&ended, 1)
+	}
+
+	conns, peers := pipeConns(t, s, 20, nil)
+	for i, peer := range peers {
+		go conns[i].Stop()
+		peer.Close()
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for s.ExistsConn() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if s.ExistsConn() {
+		t.Fatalf("%d conns left after peer close", len(s.GetConns()))
+	}
+
+	if got := atomic.LoadInt64(&ended); got != 20 {
+		t.Errorf("OnConnEnd called %d times, want 20", got)
+	}
+}
+
+// 一个连接连续写入b.N帧, 等MsgHandler全部处理完, go test -bench Reader -benchmem
+func BenchmarkReader(b *testing.B) {
+	s := NewKananServer()
+	s.SerialDispatch = true
+
+	var handled int64
+	total := int64(b.N)
+	done := make(chan bool)
+	c1, c2 := net.Pipe()
+	s.ServeConn(c2, func(r *Request) {
+		if atomic.AddInt64(&handled, 1) == total {
+			close(done)
+		}
+	})
+	go io.Copy(ioutil.Discard, c1)
+
+	frame := EncodeCmd("order", "1", "BTC-USDT", "buy", "43210.5", "3")
+	batch := make([]byte, 0, len(frame)*100)
+	for i := 0; i < 100; i++ {
+		batch = append(batch, frame...)
+	}
+
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := b.N; n > 0; n -= 100 {
+		if n >= 100 {
+			c1.Write(batch)
+		} else {
+			c1.Write(batch[:n*len(frame)])
+		}
+	}
+	<-done
+	b.StopTimer()
+
+	c1.Close()
+	s.CloseAllConn()
+}
+
+// 读协程收到任意字节时不能panic, 对端关闭后连接要能结束
+func FuzzReader(f *testing.F) {
+	f.Add(EncodeCmd("order", "1", "BTC-USDT", "buy"))
+	f.Add(append(EncodeCmd("ping", "1"), EncodeCmd("compress", "2", "snappy")...))
+	f.Add(EncodeCmd("hello", "1", "1", "snappy", "chunk|reliable"))
+	f.Add([]byte{0xe0, 0, 0, 2, 'x', '{'})
+	f.Add([]byte{0, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := NewKananServer()
+		s.EnableCompression = true
+		s.EnableHello = true
+		c1, c2 := net.Pipe()
+		conn := s.ServeConn(c2, func(r *Request) {
+			ParseOp(r.GetData())
+		})
+		go io.Copy(ioutil.Discard, c1)
+
+		c1.SetWriteDeadline(time.Now().Add(time.Second))
+		c1.Write(data)
+		c1.Close()
+
+		deadline := time.Now().Add(time.Second * 2)
+		for !conn.IsClosed() {
+			if time.Now().After(deadline) {
+				t.Fatal("conn not closed after peer close")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// epoll事件循环: 所有连接的读取由EventLoops个loop协程负责, 写协程只在发送队列有消息时存在
+// 适合大量空闲的行情订阅连接, 每个连接省下两个协程和读缓冲
+// SerialDispatch时MsgHandler在loop协程里执行, 会阻塞同一个loop上的其他连接; 内置op总是在单独的协程里执行
+
+var ErrEventLoopUnsupported = errors.New("event loop transport is not supported on this platform")
+
+var errEventLoopClosed = errors.New("event loop closed")
+
+const eventLoopReadSize = 64 * 1024
+
+func (c *KannaServer) startEventLoops() error {
+	c.eventLoopLock.Lock()
+	defer c.eventLoopLock.Unlock()
+
+	if len(c.eventLoops) > 0 {
+		return nil
+	}
+
+	n := c.EventLoops
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	var loops []*eventLoop
+	for i := 0; i < n; i++ {
+		loop, err := newEventLoop(c)
+		if err != nil {
+			for _, l := range loops {
+				l.close()
+			}
+			return err
+		}
+		loops = append(loops, loop)
+	}
+
+	for _, loop := range loops {
+		go loop.run()
+	}
+	c.eventLoops = loops
+
+	return nil
+}
+
+// 关闭ServeEventLoop接受的所有连接并退出loop协程, 需要先关闭listener
+// 之后可以再次调用ServeEventLoop
+func (c *KannaServer) CloseEventLoops() {
+	c.eventLoopLock.Lock()
+	loops := c.eventLoops
+	c.eventLoops = nil
+	c.eventLoopLock.Unlock()
+
+	for _, conn := range c.GetConns() {
+		if ec, ok := conn.(*KannaEventLoopConnection); ok {
+			ec.Stop()
+		}
+	}
+
+	for _, loop := range loops {
+		loop.stop()
+	}
+}
+
+func (c *KannaServer) nextEventLoop() *eventLoop {
+	c.eventLoopLock.Lock()
+	defer c.eventLoopLock.Unlock()
+
+	if len(c.eventLoops) == 0 {
+		return nil
+	}
+
+	c.eventLoopNext++
+	return c.eventLoops[c.eventLoopNext%uint32(len(c.eventLoops))]
+}
+
+// 和Serve一样, 但连接由epoll读取, 只在Linux上可用, 其他平台返回ErrEventLoopUnsupported
+// 同一个server可以同时有Serve和ServeEventLoop的listener
+func (c *KannaServer) ServeEventLoop(listener net.Listener, msgHandler MsgHandler) error {
+	if err := c.startEventLoops(); err != nil {
+		return err
+	}
+
+	return c.serve(listener, msgHandler, true)
+}
+
+// 只支持能取得fd的连接, 比如TCP和unix socket
+func NewKannaEventLoopConnection(server *KannaServer, ID int, conn net.Conn, handler MsgHandler) (*KannaEventLoopConnection, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("%T has no fd", conn)
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	fd := -1
+	if err := raw.Control(func(v uintptr) { fd = int(v) }); err != nil {
+		return nil, err
+	}
+
+	loop := server.nextEventLoop()
+	if loop == nil {
+		return nil, ErrEventLoopUnsupported
+	}
+
+	c := &KannaEventLoopConnection{
+		sKannaConnection: newKannaConnection(server, ID, conn, handler),
+		Conn:             conn,
+		loop:             loop,
+		fd:               fd,
+		raw:              raw,
+	}
+	c.offload = c.offloadBuiltin
+
+	c.Server.AddConn(c)
+	return c, nil
+}
+
+func (c *KannaEventLoopConnection) SendMsg(data []byte) error {
+	if err := c.send(c, data); err != nil {
+		return err
+	}
+
+	c.flush()
+	return nil
+}
+
+func (c *KannaEventLoopConnection) SendReliable(data []byte) (uint64, error) {
+	return c.sendReliable(c, data)
+}
+
+func (c *KannaEventLoopConnection) Start() {
+	c.Server.record(CaptureOpen, c.ID, nil)
+
+	// 和start一样, 加入epoll之前创建session
+	c.startSession(c)
+	if err := c.loop.add(c); err != nil {
+		log.Println("event loop add err", c.ID, err)
+		c.Stop()
+	}
+}
+
+func (c *KannaEventLoopConnection) Stop() {
+	c.stop(c, eventLoopCloser{c})
+}
+
+// 先从epoll移除再关闭, 避免fd被新连接复用后收到旧的事件
+type eventLoopCloser struct {
+	c *KannaEventLoopConnection
+}
+
+func (e eventLoopCloser) Close() error {
+	e.c.loop.remove(e.c)
+	return e.c.Conn.Close()
+}
+
+// 有消息时才启动写协程, 队列空了就退出
+func (c *KannaEventLoopConnection) flush() {
+	if atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+		go c.writeLoop()
+	}
+}
+
+func (c *KannaEventLoopConnection) writeLoop() {
+	for {
+		select {
+		case data := <-c.msgChan:
+			bufs := c.collectBatch(data)
+			n := len(bufs)
+			if _, err := bufs.WriteTo(c.Conn); err != nil {
+				log.Println("Send Data Err:", err)
+				c.Stop()
+				return
+			}
+			c.traceWritten(n)
+			c.notifyDrained()
+
+		case <-c.ExitBuffChan:
+			return
+
+		default:
+			atomic.StoreInt32(&c.writing, 0)
+
+			// 退出前又有消息入队, 而SendMsg看到的还是writing为1
+			if len(c.msgChan) == 0 || !atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+				return
+			}
+		}
+	}
+}
+
+// loop协程收到可读事件后调用, buf为loop共用的读缓冲
+func (c *KannaEventLoopConnection) onReadable(buf []byte) {
+	readStart := time.Now()
+	n, err := c.read(buf)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+
+	if err != nil || n == 0 {
+		c.Stop()
+		return
+	}
+
+	if c.allowTelnet() {
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		c.handleTelnet(c, data)
+		return
+	}
+
+	c.handleData(buf[:n], readStart)
+}
+
+// 按帧处理读到的数据, 不完整的帧和暂停之后的数据留在pending
+func (c *KannaEventLoopConnection) handleData(data []byte, readStart time.Time) {
+	if len(c.pending) > 0 {
+		c.pending = append(c.pending, data...)
+		data = c.pending
+	}
+
+	for len(data) >= PackHeadLen && !c.paused {
+		msgLen := binary.BigEndian.Uint32(data)
+		bodyLen := msgLen &^ frameFlagMask
+		if bodyLen > uint32(c.Server.maxMsgLen()) {
+			fmt.Println("message too large, auto closing", bodyLen)
+			c.Stop()
+			return
+		}
+
+		end := PackHeadLen + int(bodyLen)
+		if len(data) < end {
+			break
+		}
+
+		if bodyLen > 0 {
+			frame := getBuffer(int(bodyLen))
+			copy(*frame, data[PackHeadLen:end])
+			if err := c.handleFrame(c, msgLen, frame, readStart); err != nil {
+				fmt.Println("decode msg data error ", err)
+				c.Stop()
+				return
+			}
+		}
+
+		data = data[end:]
+	}
+
+	// 空闲连接不保留缓冲
+	if len(data) == 0 {
+		c.pending = nil
+	} else {
+		c.pending = append(c.pending[:0], data...)
+	}
+
+	// pending保存好之后才交给新的协程
+	if c.paused {
+		run := c.builtin
+		c.builtin = nil
+		c.loop.remove(c)
+
+		go func() {
+			run()
+			c.resume()
+		}()
+	}
+}
+
+// 内置op的回复可能要发很多帧(比如resume重发), 发送队列满时会阻塞, 不能在loop协程里执行
+// 执行期间连接从epoll移除, 之后收到的帧等它执行完再按顺序处理, 保证compress和hello之后的帧能正确解码
+func (c *KannaEventLoopConnection) offloadBuiltin(run func()) {
+	c.paused = true
+	c.builtin = run
+}
+
+func (c *KannaEventLoopConnection) resume() {
+	c.paused = false
+	if c.IsClosed() {
+		c.pending = nil
+		return
+	}
+
+	c.handleData(nil, time.Now())
+
+	// 剩下的数据里还有内置op, 由新的协程继续
+	if c.paused {
+		return
+	}
+
+	if err := c.loop.resume(c); err != nil {
+		log.Println("event loop resume err", c.ID, err)
+		c.Stop()
+	}
+}
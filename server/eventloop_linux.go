@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"log"
+	"sync"
+	"syscall"
+)
+
+type eventLoop struct {
+	server *KannaServer
+	epfd   int
+	wake   [2]int                            // 关闭时写wake[1], 唤醒EpollWait
+	closed bool                              // 由lock保护, 之后不能再操作epfd
+	done   chan bool                         // run退出后close
+	conns  map[int]*KannaEventLoopConnection // 按fd
+	lock   sync.RWMutex
+	buf    []byte // 只在run协程里使用
+}
+
+func newEventLoop(server *KannaServer) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	var wake [2]int
+	if err := syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	l := &eventLoop{
+		server: server,
+		epfd:   epfd,
+		wake:   wake,
+		done:   make(chan bool),
+		conns:  make(map[int]*KannaEventLoopConnection),
+		buf:    make([]byte, eventLoopReadSize),
+	}
+
+	ev := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, wake[0], ev); err != nil {
+		l.close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// 释放epfd和wake, run没有启动时直接调用, 启动后由run退出时调用
+func (l *eventLoop) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+	syscall.Close(l.epfd)
+	syscall.Close(l.wake[0])
+	syscall.Close(l.wake[1])
+}
+
+// 通知run退出并等待epfd关闭, 可以重复调用
+func (l *eventLoop) stop() {
+	l.lock.RLock()
+	if !l.closed {
+		syscall.Write(l.wake[1], []byte{1})
+	}
+	l.lock.RUnlock()
+
+	<-l.done
+}
+
+// 水平触发, 一次没读完的下一轮还会通知
+func (l *eventLoop) add(c *KannaEventLoopConnection) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return errEventLoopClosed
+	}
+
+	ev := &syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(c.fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, c.fd, ev); err != nil {
+		return err
+	}
+
+	l.conns[c.fd] = c
+	return nil
+}
+
+// 执行完内置op后重新加入, 期间已经Stop的连接不再加入, 避免fd关闭后被复用
+func (l *eventLoop) resume(c *KannaEventLoopConnection) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if c.IsClosed() {
+		return nil
+	}
+
+	if l.closed {
+		return errEventLoopClosed
+	}
+
+	ev := &syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(c.fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, c.fd, ev); err != nil {
+		return err
+	}
+
+	l.conns[c.fd] = c
+	return nil
+}
+
+func (l *eventLoop) remove(c *KannaEventLoopConnection) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.conns[c.fd] != c {
+		return
+	}
+
+	delete(l.conns, c.fd)
+	if !l.closed {
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	}
+}
+
+func (l *eventLoop) run() {
+	defer close(l.done)
+	defer l.close()
+
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+
+			log.Println("epoll wait err", err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			if int(events[i].Fd) == l.wake[0] {
+				return
+			}
+
+			l.lock.RLock()
+			c := l.conns[int(events[i].Fd)]
+			l.lock.RUnlock()
+
+			// 挂断和错误也走读取, 读到EOF或者错误后关闭
+			if c != nil {
+				c.onReadable(l.buf)
+			}
+		}
+	}
+}
+
+// 通过RawConn读取, 连接已经关闭时返回错误而不是读到复用这个fd的新连接
+func (c *KannaEventLoopConnection) read(buf []byte) (int, error) {
+	var n int
+	var rerr error
+	err := c.raw.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), buf)
+		return true
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		n = 0
+	}
+
+	return n, rerr
+}
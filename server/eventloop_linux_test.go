@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// 关闭后loop协程退出, 连接全部断开, 可以重新ServeEventLoop
+func TestCloseEventLoops(t *testing.T) {
+	s := NewKananServer()
+	s.EventLoops = 2
+
+	addr := startEventLoopServer(t, s, nil)
+	var clients []*KannaClient
+	for i := 0; i < 4; i++ {
+		clients = append(clients, dialTest(t, addr))
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for len(s.GetConns()) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatal("conns not accepted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	loops := s.eventLoops
+	s.CloseEventLoops()
+
+	for _, loop := range loops {
+		select {
+		case <-loop.done:
+		default:
+			t.Fatal("loop still running")
+		}
+	}
+
+	if s.ExistsConn() {
+		t.Fatalf("%d conns left", len(s.GetConns()))
+	}
+
+	for _, client := range clients {
+		if _, err := client.ReadFrame(); err == nil {
+			t.Fatal("client still connected")
+		}
+	}
+
+	// 第二次调用什么都不做
+	s.CloseEventLoops()
+
+	addr = startEventLoopServer(t, s, func(r *Request) {
+		r.GetConnection().SendMsg(EncodeCmd("echo", ""))
+	})
+	client := dialTest(t, addr)
+	if _, err := client.Send("ping"); err != nil {
+		t.Fatal(err)
+	}
+	readOp(t, client, "echo")
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+type eventLoop struct{}
+
+func newEventLoop(server *KannaServer) (*eventLoop, error) {
+	return nil, ErrEventLoopUnsupported
+}
+
+func (l *eventLoop) close() {}
+
+func (l *eventLoop) stop() {}
+
+func (l *eventLoop) run() {}
+
+func (l *eventLoop) add(c *KannaEventLoopConnection) error {
+	return ErrEventLoopUnsupported
+}
+
+func (l *eventLoop) resume(c *KannaEventLoopConnection) error {
+	return ErrEventLoopUnsupported
+}
+
+func (l *eventLoop) remove(c *KannaEventLoopConnection) {}
+
+func (c *KannaEventLoopConnection) read(buf []byte) (int, error) {
+	return 0, ErrEventLoopUnsupported
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startEventLoopServer(t *testing.T, s *KannaServer, handler MsgHandler) string {
+	if err := s.startEventLoops(); err == ErrEventLoopUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		s.CloseAllConn()
+	})
+
+	go s.ServeEventLoop(l, handler)
+	return l.Addr().String()
+}
+
+func dialTest(t *testing.T, addr string) *KannaClient {
+	client, err := DialKanna(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Conn.SetDeadline(time.Now().Add(time.Second * 5))
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// 读到指定op的帧, 跳过session等其他帧
+func readOp(t *testing.T, client *KannaClient, op string) *Frame {
+	for {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", op, err)
+		}
+
+		if frame.Op == op {
+			return frame
+		}
+	}
+}
+
+// resume重发时对端不读, 发送队列会一直满, 不能阻塞同一个loop上的其他连接
+func TestEventLoopResumeDoesNotBlockLoop(t *testing.T) {
+	s := NewKananServer()
+	s.EnableSession = true
+	s.EventLoops = 1
+	s.WriteQueueSize = 1
+	s.SessionBufferSize = 200
+
+	addr := startEventLoopServer(t, s, func(r *Request) {
+		r.GetConnection().SendMsg(EncodeCmd("echo", "", string(r.GetData())))
+	})
+
+	first := dialTest(t, addr)
+	token := readOp(t, first, OpSession).Values()[0]
+
+	deadline := time.Now().Add(time.Second * 2)
+	for len(s.GetConns()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("conn not accepted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conn := s.GetConns()[0]
+
+	first.Close()
+	sess := conn.(*KannaEventLoopConnection).GetSession()
+	for !sess.IsDetached() {
+		if time.Now().After(deadline) {
+			t.Fatal("session not detached after peer close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 断线期间缓存远超过socket缓冲区的数据
+	big := EncodeCmd("tick", "", strings.Repeat("x", 64*1024))
+	for i := 0; i < 200; i++ {
+		if err := conn.SendMsg(big); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resumed := dialTest(t, addr)
+	if _, err := resumed.Send(OpResume, token); err != nil {
+		t.Fatal(err)
+	}
+
+	// 等loop读到resume
+	time.Sleep(time.Millisecond * 100)
+
+	other := dialTest(t, addr)
+	if _, err := other.Send("ping"); err != nil {
+		t.Fatal(err)
+	}
+	readOp(t, other, "echo")
+
+	// 恢复的连接最终能收到全部缓存的消息
+	reply := readOp(t, resumed, OpResume)
+	if vals := reply.Values(); vals[0] != "ok" || vals[2] != "200" {
+		t.Fatalf("resume reply %q", vals)
+	}
+
+	for i := 0; i < 200; i++ {
+		readOp(t, resumed, "tick")
+	}
+}
+
+// compress之后紧跟的压缩帧要在协商完成后才解码
+func TestEventLoopCompressPipelined(t *testing.T) {
+	s := NewKananServer()
+	s.EnableCompression = true
+	s.EventLoops = 1
+
+	addr := startEventLoopServer(t, s, func(r *Request) {
+		r.GetConnection().SendMsg(EncodeCmd("echo", "", string(r.GetData())))
+	})
+
+	client := dialTest(t, addr)
+	snappy := GetCompressor("snappy")
+	body := []byte("order{" + strings.Repeat("BTC-USDT,", 100) + "}1")
+	compressed, err := snappy.Compress(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := EncodeFrame(compressed)
+	frame[0] |= byte(FrameFlagCompressed >> 24)
+
+	// 一次写入, loop在同一次读里拿到两帧
+	if err := client.SendRaw(append(EncodeCmd(OpCompress, "0", "snappy"), frame...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if vals := readOp(t, client, OpCompress).Values(); vals[0] != "snappy" {
+		t.Fatalf("compress reply %q", vals)
+	}
+	client.codec = snappy
+
+	readOp(t, client, "echo")
+}
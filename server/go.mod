@@ -1,3 +1,7 @@
 module github.com/kdays/kanna/server
 
-go 1.15
+go 1.18
+
+require github.com/golang/snappy v0.0.4
+
+require github.com/shopspring/decimal v1.2.0
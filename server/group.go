@@ -0,0 +1,220 @@
+package server
+
+import (
+	"sync"
+)
+
+// 命名的连接分组, 比如同一个账号的所有连接, 组内共享Props
+// 连接Stop时自动退出所有分组, 最后一个成员退出后分组被删除, SetPersistent(true)的除外
+type Group struct {
+	Name  string
+	Props *sync.Map
+
+	server     *KannaServer
+	members    map[int]IKannaConnBehavior // 由server.groupLock保护
+	persistent bool                       // 由server.groupLock保护
+}
+
+// 持久的分组没有成员时也保留, 取消时如果已经没有成员就删除
+func (g *Group) SetPersistent(persistent bool) {
+	g.server.groupLock.Lock()
+	defer g.server.groupLock.Unlock()
+
+	g.persistent = persistent
+	if !persistent && len(g.members) == 0 && g.server.groups[g.Name] == g {
+		delete(g.server.groups, g.Name)
+	}
+}
+
+func (g *Group) IsPersistent() bool {
+	g.server.groupLock.RLock()
+	defer g.server.groupLock.RUnlock()
+
+	return g.persistent
+}
+
+func (g *Group) Members() (res []IKannaConnBehavior) {
+	g.server.groupLock.RLock()
+	defer g.server.groupLock.RUnlock()
+
+	for _, conn := range g.members {
+		res = append(res, conn)
+	}
+
+	return res
+}
+
+func (g *Group) Len() int {
+	g.server.groupLock.RLock()
+	defer g.server.groupLock.RUnlock()
+
+	return len(g.members)
+}
+
+func (g *Group) Has(conn IKannaConnBehavior) bool {
+	g.server.groupLock.RLock()
+	defer g.server.groupLock.RUnlock()
+
+	_, ok := g.members[conn.GetID()]
+	return ok
+}
+
+// 只发给本节点上的成员, 返回发送的连接数
+func (g *Group) Send(msg []byte) int {
+	members := g.Members()
+	for _, conn := range members {
+		conn.SendMsg(msg)
+	}
+
+	return len(members)
+}
+
+func (c *KannaServer) newGroup(name string) *Group {
+	return &Group{
+		Name:    name,
+		Props:   &sync.Map{},
+		server:  c,
+		members: make(map[int]IKannaConnBehavior),
+	}
+}
+
+// 没有的话创建, 用来提前设置SetPersistent或Props
+func (c *KannaServer) CreateGroup(name string) *Group {
+	c.groupLock.Lock()
+	defer c.groupLock.Unlock()
+
+	g, ok := c.groups[name]
+	if !ok {
+		g = c.newGroup(name)
+		c.groups[name] = g
+	}
+
+	return g
+}
+
+// 不存在时返回nil
+func (c *KannaServer) GetGroup(name string) *Group {
+	c.groupLock.RLock()
+	defer c.groupLock.RUnlock()
+
+	return c.groups[name]
+}
+
+// 直接删除分组, 成员会收到OnGroupLeave
+func (c *KannaServer) RemoveGroup(name string) {
+	c.groupLock.Lock()
+	g, ok := c.groups[name]
+	if !ok {
+		c.groupLock.Unlock()
+		return
+	}
+
+	delete(c.groups, name)
+	var members []IKannaConnBehavior
+	for _, conn := range g.members {
+		members = append(members, conn)
+	}
+	g.members = make(map[int]IKannaConnBehavior)
+	c.groupLock.Unlock()
+
+	for _, conn := range members {
+		c.onGroupLeave(g, conn)
+	}
+}
+
+// 连接已经关闭时返回nil, 否则它不会再被leaveAllGroups移出
+func (c *KannaServer) JoinGroup(conn IKannaConnBehavior, name string) *Group {
+	c.groupLock.Lock()
+	if conn.IsClosed() {
+		c.groupLock.Unlock()
+		return nil
+	}
+
+	g, ok := c.groups[name]
+	if !ok {
+		g = c.newGroup(name)
+		c.groups[name] = g
+	}
+
+	_, joined := g.members[conn.GetID()]
+	g.members[conn.GetID()] = conn
+	c.groupLock.Unlock()
+
+	if !joined && c.OnGroupJoin != nil {
+		c.OnGroupJoin(g, conn)
+	}
+
+	return g
+}
+
+func (c *KannaServer) LeaveGroup(conn IKannaConnBehavior, name string) {
+	c.groupLock.Lock()
+	g, ok := c.groups[name]
+	if !ok {
+		c.groupLock.Unlock()
+		return
+	}
+
+	_, joined := g.members[conn.GetID()]
+	c.removeMember(g, conn)
+	c.groupLock.Unlock()
+
+	if joined {
+		c.onGroupLeave(g, conn)
+	}
+}
+
+// 连接所在的分组
+func (c *KannaServer) GetGroupsOf(conn IKannaConnBehavior) (res []*Group) {
+	c.groupLock.RLock()
+	defer c.groupLock.RUnlock()
+
+	for _, g := range c.groups {
+		if _, ok := g.members[conn.GetID()]; ok {
+			res = append(res, g)
+		}
+	}
+
+	return res
+}
+
+// 分组不存在时返回0
+func (c *KannaServer) SendToGroup(name string, msg []byte) int {
+	g := c.GetGroup(name)
+	if g == nil {
+		return 0
+	}
+
+	return g.Send(msg)
+}
+
+// 需要持有groupLock
+func (c *KannaServer) removeMember(g *Group, conn IKannaConnBehavior) {
+	delete(g.members, conn.GetID())
+	if len(g.members) == 0 && !g.persistent {
+		delete(c.groups, g.Name)
+	}
+}
+
+func (c *KannaServer) onGroupLeave(g *Group, conn IKannaConnBehavior) {
+	if c.OnGroupLeave != nil {
+		c.OnGroupLeave(g, conn)
+	}
+}
+
+// 连接停止时退出所有分组
+func (c *KannaServer) leaveAllGroups(conn IKannaConnBehavior) {
+	c.groupLock.Lock()
+	var left []*Group
+	for _, g := range c.groups {
+		if _, ok := g.members[conn.GetID()]; ok {
+			c.removeMember(g, conn)
+			left = append(left, g)
+		}
+	}
+	c.groupLock.Unlock()
+
+	for _, g := range left {
+		c.onGroupLeave(g, conn)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupJoinLeave(t *testing.T) {
+	s := NewKananServer()
+	var joins, leaves int
+	s.OnGroupJoin = func(g *Group, conn IKannaConnBehavior) { joins++ }
+	s.OnGroupLeave = func(g *Group, conn IKannaConnBehavior) { leaves++ }
+
+	conn, client := pipeClient(t, s, nil)
+	g := s.JoinGroup(conn, "acct")
+	if g == nil || !g.Has(conn) {
+		t.Fatal("conn not in group after JoinGroup")
+	}
+
+	// 重复加入不再触发OnGroupJoin
+	s.JoinGroup(conn, "acct")
+	if joins != 1 {
+		t.Fatalf("OnGroupJoin called %d times, want 1", joins)
+	}
+
+	if n := s.SendToGroup("acct", EncodeCmd("hi", "", "1")); n != 1 {
+		t.Fatalf("SendToGroup sent to %d conns, want 1", n)
+	}
+	expectOp(t, client, "hi")
+
+	s.LeaveGroup(conn, "acct")
+	if leaves != 1 {
+		t.Fatalf("OnGroupLeave called %d times, want 1", leaves)
+	}
+
+	// 最后一个成员退出后分组被删除
+	if s.GetGroup("acct") != nil {
+		t.Fatal("empty group not removed")
+	}
+}
+
+// 断开时退出所有分组并触发OnGroupLeave
+func TestGroupLeaveOnDisconnect(t *testing.T) {
+	s := NewKananServer()
+	left := make(chan string, 2)
+	s.OnGroupLeave = func(g *Group, conn IKannaConnBehavior) { left <- g.Name }
+
+	conn, client := pipeClient(t, s, nil)
+	s.JoinGroup(conn, "a")
+	s.JoinGroup(conn, "b")
+	s.CreateGroup("b").SetPersistent(true)
+
+	client.Close()
+	names := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-left:
+			names[name] = true
+		case <-time.After(time.Second):
+			t.Fatalf("got OnGroupLeave for %v, want a and b", names)
+		}
+	}
+
+	if len(s.GetGroupsOf(conn)) != 0 {
+		t.Fatal("closed conn still in groups")
+	}
+
+	if s.GetGroup("a") != nil {
+		t.Fatal("empty group a not removed")
+	}
+
+	// 持久分组保留, 取消后删除
+	g := s.GetGroup("b")
+	if g == nil || g.Len() != 0 {
+		t.Fatal("persistent group b not kept")
+	}
+
+	g.SetPersistent(false)
+	if s.GetGroup("b") != nil {
+		t.Fatal("group b not removed after SetPersistent(false)")
+	}
+}
+
+func TestJoinGroupClosedConn(t *testing.T) {
+	s := NewKananServer()
+	conn, _ := pipeClient(t, s, nil)
+	conn.Stop()
+
+	if g := s.JoinGroup(conn, "acct"); g != nil {
+		t.Fatal("JoinGroup on closed conn returned a group")
+	}
+
+	if s.GetGroup("acct") != nil {
+		t.Fatal("JoinGroup on closed conn created a group")
+	}
+}
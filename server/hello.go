@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 连接后可选的握手 hello{version,codec,features}, codec和features用|分隔, 需要开启EnableHello
+// 回复 hello{version\tcodec\tfeatures}msgId, 版本不支持时回复 hello{fail\treason}msgId
+// 不发hello的旧客户端保持原来的帧格式, 不会收到可靠帧和分块帧
+const OpHello = "hello"
+
+// 当前协议版本, 客户端版本更高时按服务端的版本
+const ProtocolVersion = 1
+
+const FeatureCompress = "compress"
+const FeatureReliable = "reliable"
+const FeatureSession = "session"
+const FeatureChunk = "chunk"
+
+// 握手协商出来的结果
+type Capabilities struct {
+	Version  int
+	Codec    string // 没有压缩时为none
+	Features map[string]bool
+}
+
+func (c *Capabilities) Has(feature string) bool {
+	return c.Features[feature]
+}
+
+func (c *Capabilities) FeatureList() []string {
+	var res []string
+	for name, ok := range c.Features {
+		if ok {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// 握手之前为nil
+func (c *sKannaConnection) GetCapabilities() *Capabilities {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.caps
+}
+
+// 协商时启用了该功能, 没有握手时只允许不改变帧格式的功能
+func connSupports(conn IKannaConnBehavior, feature string) bool {
+	caps := conn.GetCapabilities()
+	if caps == nil {
+		return feature != FeatureReliable && feature != FeatureChunk
+	}
+
+	return caps.Has(feature)
+}
+
+func (c *KannaServer) supportedFeatures() map[string]bool {
+	return map[string]bool{
+		FeatureCompress: c.enableCompression(),
+		FeatureReliable: c.EnableReliable,
+		FeatureSession:  c.EnableSession,
+		FeatureChunk:    true,
+	}
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, "|") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+func (c *sKannaConnection) handleHello(conn IKannaConnBehavior, cmd *OpCmd) {
+	reply := NewDataPack(OpHello)
+	reply.SetMsgId(cmd.MsgId)
+
+	args := make([]string, 3)
+	copy(args, cmd.Args)
+
+	version, err := strconv.Atoi(strings.TrimSpace(args[0]))
+	if err != nil || version < 1 {
+		reply.PushData("fail", "invalid version")
+		conn.SendMsg(reply.Pack())
+		return
+	}
+
+	if min := c.Server.MinProtocolVersion; min > 0 && version < min {
+		reply.PushData("fail", fmt.Sprintf("version %d not supported, need at least %d", version, min))
+		conn.SendMsg(reply.Pack())
+		return
+	}
+
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	caps := &Capabilities{Version: version, Codec: "none", Features: make(map[string]bool)}
+	supported := c.Server.supportedFeatures()
+	for _, name := range splitList(args[2]) {
+		if supported[name] {
+			caps.Features[name] = true
+		}
+	}
+
+	var codec Compressor
+	if caps.Has(FeatureCompress) {
+		codec = selectCompressor(splitList(args[1]))
+	}
+
+	if codec == nil {
+		delete(caps.Features, FeatureCompress)
+	} else {
+		caps.Codec = codec.Name()
+	}
+
+	c.stateLock.Lock()
+	c.caps = caps
+	c.stateLock.Unlock()
+
+	reply.PushData(caps.Version, caps.Codec, strings.Join(caps.FeatureList(), "|"))
+
+	// 和compress一样, 回复本身不压缩
+	conn.SendMsg(reply.Pack())
+	c.setCodec(codec)
+}
+
+// 客户端发起握手, 返回服务端选中的结果, 选中压缩时之后的帧自动解压
+func (c *KannaClient) Hello(version int, codecs []string, features []string) (*Capabilities, error) {
+	msgId, err := c.Send(OpHello, strconv.Itoa(version), strings.Join(codecs, "|"), strings.Join(features, "|"))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		frame, err := c.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if frame.Op != OpHello || frame.MsgId != msgId {
+			continue
+		}
+
+		vals := append(frame.Values(), "", "", "")
+		if vals[0] == "fail" {
+			return nil, fmt.Errorf("hello failed: %s", vals[1])
+		}
+
+		v, err := strconv.Atoi(vals[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hello reply %q", frame.Raw)
+		}
+
+		caps := &Capabilities{Version: v, Codec: vals[1], Features: make(map[string]bool)}
+		for _, name := range splitList(vals[2]) {
+			caps.Features[name] = true
+		}
+
+		c.codec = GetCompressor(caps.Codec)
+		return caps, nil
+	}
+}
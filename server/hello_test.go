@@ -0,0 +1,91 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 默认不拦截hello, 和其他op一样交给MsgHandler
+func TestHelloDisabledByDefault(t *testing.T) {
+	s := NewKananServer()
+	s.EnableReliable = true
+
+	ops := make(chan string, 1)
+	_, client := pipeClient(t, s, func(r *Request) {
+		if cmd := ParseOp(r.GetData()); cmd != nil {
+			ops <- cmd.Op
+		}
+	})
+
+	if _, err := client.Send(OpHello, "1", "", FeatureReliable); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case op := <-ops:
+		if op != OpHello {
+			t.Fatalf("handler got %q, want %q", op, OpHello)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hello not passed to MsgHandler")
+	}
+}
+
+// 没有握手的旧客户端不能收到带可靠标记的帧
+func TestReliableNeedsHello(t *testing.T) {
+	s := NewKananServer()
+	s.EnableReliable = true
+	s.EnableHello = true
+
+	conn, client := pipeClient(t, s, nil)
+	if _, err := conn.SendReliable(EncodeCmd("order", "", "1")); err == nil {
+		t.Fatal("SendReliable without hello returned nil")
+	}
+
+	caps, err := client.Hello(ProtocolVersion, nil, []string{FeatureReliable})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !caps.Has(FeatureReliable) {
+		t.Fatalf("reliable not negotiated: %v", caps.FeatureList())
+	}
+
+	if _, err := conn.SendReliable(EncodeCmd("order", "", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame.Flags&FrameFlagReliable == 0 || frame.Op != "order" {
+		t.Fatalf("got %+v, want reliable order frame", frame)
+	}
+}
+
+// 没有握手时StreamWriter不拆分, 整个结果是一个普通帧
+func TestStreamNoChunkWithoutHello(t *testing.T) {
+	s := NewKananServer()
+	conn, client := pipeClient(t, s, nil)
+
+	w := NewStreamWriter(conn, "rows", "3")
+	w.ChunkSize = 16
+	go func() {
+		for i := 0; i < 10; i++ {
+			w.Push(i, strings.Repeat("x", 10))
+		}
+		w.Close()
+	}()
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame.Chunk != 0 || len(frame.Rows) != 10 {
+		t.Fatalf("got chunk %d with %d rows, want one plain frame with 10 rows", frame.Chunk, len(frame.Rows))
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 连接ID生成器, 每个KannaServer各自持有, 必须并发安全
+type IDGenerator interface {
+	NextID() int
+}
+
+type monotonicIDGenerator struct {
+	last int64
+}
+
+// 从start开始递增, 需要重启后不重复的话start传入上次的最大值或者当前时间
+func NewMonotonicIDGenerator(start int64) IDGenerator {
+	return &monotonicIDGenerator{last: start}
+}
+
+func (g *monotonicIDGenerator) NextID() int {
+	return int(atomic.AddInt64(&g.last, 1))
+}
+
+// 41位毫秒时间戳 + 10位节点 + 12位序号
+const snowflakeNodeBits = 10
+const snowflakeSeqBits = 12
+const SnowflakeMaxNode = 1<<snowflakeNodeBits - 1
+
+// 2020-01-01 00:00:00 UTC
+var SnowflakeEpoch = time.Unix(1577836800, 0)
+
+type snowflakeIDGenerator struct {
+	node     int64
+	lastTime int64
+	seq      int64
+	lock     sync.Mutex
+}
+
+// 时间戳在最高位, 重启后也不会重复, 多个进程需要不同的node
+// 需要64位的int, 32位平台上截断后会重复, 直接panic
+func NewSnowflakeIDGenerator(node int) IDGenerator {
+	if strconv.IntSize < 64 {
+		panic("snowflake ID needs 64-bit int")
+	}
+
+	return &snowflakeIDGenerator{node: int64(node & SnowflakeMaxNode)}
+}
+
+// 取出snowflake ID里的节点
+func SnowflakeNode(id int) int {
+	return id >> snowflakeSeqBits & SnowflakeMaxNode
+}
+
+func (g *snowflakeIDGenerator) NextID() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Since(SnowflakeEpoch).Milliseconds()
+	if now < g.lastTime {
+		// 时钟回拨时沿用上次的时间, 靠序号区分
+		now = g.lastTime
+	}
+
+	if now == g.lastTime {
+		g.seq = (g.seq + 1) & (1<<snowflakeSeqBits - 1)
+		if g.seq == 0 {
+			// 这一毫秒的序号用完了, 等到下一毫秒
+			for now <= g.lastTime {
+				time.Sleep(time.Microsecond * 100)
+				now = time.Since(SnowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		g.seq = 0
+	}
+
+	g.lastTime = now
+	return int(now<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq)
+}
+
+type randomIDGenerator struct{}
+
+// 63位随机数, 碰撞由KannaServer重试
+func NewRandomIDGenerator() IDGenerator {
+	return &randomIDGenerator{}
+}
+
+func (g *randomIDGenerator) NextID() int {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return int(time.Now().UnixNano() & (1<<63 - 1))
+	}
+
+	return int(binary.BigEndian.Uint64(b[:]) & (1<<63 - 1))
+}
+
+// 跳过0和正在使用的ID
+func (c *KannaServer) nextConnID() int {
+	for {
+		id := c.IDGenerator.NextID()
+		if id != 0 && c.GetConn(id) == nil {
+			return id
+		}
+	}
+}
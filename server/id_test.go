@@ -0,0 +1,117 @@
+package server
+
+import (
+	"sync"
+	"testing"
+)
+
+// 并发取n*workers个ID, 检查没有重复
+func collectIDs(t *testing.T, g IDGenerator, workers, n int) [][]int {
+	res := make([][]int, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				res[w] = append(res[w], g.NextID())
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for _, ids := range res {
+		for _, id := range ids {
+			if id <= 0 {
+				t.Fatalf("got non-positive id %d", id)
+			}
+			if seen[id] {
+				t.Fatalf("duplicate id %d", id)
+			}
+			seen[id] = true
+		}
+	}
+
+	return res
+}
+
+// 每个协程拿到的ID是递增的
+func checkIncreasing(t *testing.T, ids [][]int) {
+	for _, list := range ids {
+		for i := 1; i < len(list); i++ {
+			if list[i] <= list[i-1] {
+				t.Fatalf("id %d after %d", list[i], list[i-1])
+			}
+		}
+	}
+}
+
+func TestMonotonicIDGenerator(t *testing.T) {
+	g := NewMonotonicIDGenerator(100)
+	if id := g.NextID(); id != 101 {
+		t.Fatalf("first id %d, want 101", id)
+	}
+
+	checkIncreasing(t, collectIDs(t, g, 8, 1000))
+}
+
+func TestSnowflakeIDGenerator(t *testing.T) {
+	g := NewSnowflakeIDGenerator(5)
+
+	// 一毫秒只有4096个序号, 超过时要等到下一毫秒
+	ids := collectIDs(t, g, 8, 2000)
+	checkIncreasing(t, ids)
+
+	for _, list := range ids {
+		for _, id := range list {
+			if node := SnowflakeNode(id); node != 5 {
+				t.Fatalf("id %d has node %d, want 5", id, node)
+			}
+		}
+	}
+}
+
+// 不同节点同一时刻的ID也不会相同
+func TestSnowflakeNodes(t *testing.T) {
+	seen := make(map[int]int)
+	for _, node := range []int{0, 1, 512, SnowflakeMaxNode} {
+		g := NewSnowflakeIDGenerator(node)
+		for i := 0; i < 100; i++ {
+			id := g.NextID()
+			if SnowflakeNode(id) != node {
+				t.Fatalf("id %d has node %d, want %d", id, SnowflakeNode(id), node)
+			}
+			if other, ok := seen[id]; ok {
+				t.Fatalf("id %d generated by node %d and %d", id, other, node)
+			}
+			seen[id] = node
+		}
+	}
+}
+
+func TestRandomIDGenerator(t *testing.T) {
+	collectIDs(t, NewRandomIDGenerator(), 4, 1000)
+}
+
+type fixedIDGenerator []int
+
+func (g *fixedIDGenerator) NextID() int {
+	id := (*g)[0]
+	*g = (*g)[1:]
+	return id
+}
+
+// 跳过0和正在使用的ID
+func TestNextConnIDSkipsUsed(t *testing.T) {
+	s := NewKananServer()
+	s.IDGenerator = &fixedIDGenerator{1, 0, 1, 2}
+
+	conns, peers := pipeConns(t, s, 1, nil)
+	defer peers[0].Close()
+	defer conns[0].Stop()
+
+	if id := s.nextConnID(); id != 2 {
+		t.Fatalf("got id %d, want 2", id)
+	}
+}
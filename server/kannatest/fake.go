@@ -0,0 +1,188 @@
+package kannatest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/kdays/kanna/server"
+)
+
+// 记录所有发出去的帧, 不做任何网络IO
+type FakeConn struct {
+	ID    int
+	Props *sync.Map
+
+	sent        [][]byte
+	closed      bool
+	started     bool
+	allowTelnet bool
+	handler     server.MsgHandler
+	session     *server.Session
+	caps        *server.Capabilities
+	seq         uint64
+	lock        sync.Mutex
+}
+
+func NewFakeConn(id int) *FakeConn {
+	return &FakeConn{
+		ID:    id,
+		Props: &sync.Map{},
+	}
+}
+
+func (f *FakeConn) Start() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.started = true
+}
+
+func (f *FakeConn) Stop() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.closed = true
+}
+
+func (f *FakeConn) IsClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.closed
+}
+
+func (f *FakeConn) IsStarted() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.started
+}
+
+func (f *FakeConn) GetID() int {
+	return f.ID
+}
+
+func (f *FakeConn) SendMsg(data []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return fmt.Errorf("connection closed")
+	}
+
+	// 调用方可能会复用data
+	f.sent = append(f.sent, append([]byte(nil), data...))
+	return nil
+}
+
+// 直接记录原始帧, Frame.Seq为0
+func (f *FakeConn) SendReliable(data []byte) (uint64, error) {
+	if err := f.SendMsg(data); err != nil {
+		return 0, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.seq++
+	return f.seq, nil
+}
+
+func (f *FakeConn) SetMsgHandler(h server.MsgHandler) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.handler = h
+}
+
+func (f *FakeConn) GetProps() *sync.Map {
+	return f.Props
+}
+
+func (f *FakeConn) SetAllowTelnet(to bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.allowTelnet = to
+}
+
+func (f *FakeConn) GetSession() *server.Session {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.session
+}
+
+func (f *FakeConn) SetSession(sess *server.Session) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.session = sess
+}
+
+func (f *FakeConn) GetCapabilities() *server.Capabilities {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.caps
+}
+
+// 模拟hello握手的结果
+func (f *FakeConn) SetCapabilities(caps *server.Capabilities) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.caps = caps
+}
+
+// 通过SetMsgHandler设置的handler处理一条消息, 同步执行
+func (f *FakeConn) Receive(data []byte) {
+	f.lock.Lock()
+	h := f.handler
+	f.lock.Unlock()
+
+	if h != nil {
+		h(server.NewRequest(f, data))
+	}
+}
+
+func (f *FakeConn) Sent() [][]byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([][]byte(nil), f.sent...)
+}
+
+func (f *FakeConn) Reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.sent = nil
+}
+
+func (f *FakeConn) Frames(t testing.TB) (res []*Frame) {
+	t.Helper()
+
+	for _, b := range f.Sent() {
+		res = append(res, MustDecodeFrame(t, b))
+	}
+
+	return res
+}
+
+func (f *FakeConn) LastFrame(t testing.TB) *Frame {
+	t.Helper()
+
+	sent := f.Sent()
+	if len(sent) == 0 {
+		t.Fatalf("conn %d sent nothing", f.ID)
+	}
+
+	return MustDecodeFrame(t, sent[len(sent)-1])
+}
+
+// 同步调用handler, data不带包头
+func Do(h server.MsgHandler, conn server.IKannaConnBehavior, op string, msgId string, args ...string) {
+	h(server.NewRequest(conn, EncodeCmd(op, msgId, args...)[server.PackHeadLen:]))
+}
@@ -0,0 +1,73 @@
+package kannatest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kdays/kanna/server"
+)
+
+type Frame = server.Frame
+
+// 拼一个客户端发给服务端的帧, 参数用逗号分隔
+func EncodeCmd(op string, msgId string, args ...string) []byte {
+	return server.EncodeCmd(op, msgId, args...)
+}
+
+// 解析带包头的一帧, 不支持压缩帧
+func DecodeFrame(b []byte) (*Frame, error) {
+	return server.DecodeFrame(b, nil)
+}
+
+func MustDecodeFrame(t testing.TB, b []byte) *Frame {
+	t.Helper()
+
+	frame, err := DecodeFrame(b)
+	if err != nil {
+		t.Fatalf("decode frame: %v", err)
+	}
+
+	return frame
+}
+
+func AssertOp(t testing.TB, b []byte, op string) *Frame {
+	t.Helper()
+
+	frame := MustDecodeFrame(t, b)
+	if frame.Op != op {
+		t.Fatalf("op = %q, want %q (frame %q)", frame.Op, op, b)
+	}
+
+	return frame
+}
+
+// 检查op和第一行的值
+func AssertFrame(t testing.TB, b []byte, op string, values ...string) *Frame {
+	t.Helper()
+
+	frame := AssertOp(t, b, op)
+	if !reflect.DeepEqual(frame.Values(), values) && !(len(values) == 0 && len(frame.Values()) == 0) {
+		t.Fatalf("%s values = %q, want %q", op, frame.Values(), values)
+	}
+
+	return frame
+}
+
+func AssertRows(t testing.TB, b []byte, op string, rows [][]string) *Frame {
+	t.Helper()
+
+	frame := AssertOp(t, b, op)
+	if !reflect.DeepEqual(frame.Rows, rows) && !(len(rows) == 0 && len(frame.Rows) == 0) {
+		t.Fatalf("%s rows = %q, want %q", op, frame.Rows, rows)
+	}
+
+	return frame
+}
+
+func AssertMsgId(t testing.TB, frame *Frame, msgId string) {
+	t.Helper()
+
+	if frame.MsgId != msgId {
+		t.Fatalf("%s msgId = %q, want %q", frame.Op, frame.MsgId, msgId)
+	}
+}
@@ -0,0 +1,176 @@
+package kannatest
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/kdays/kanna/server"
+)
+
+// price{symbol} 回复 price{symbol\tprice}, list{} 回复两行
+func testHandler(r *server.Request) {
+	cmd := server.ParseOp(r.GetData())
+	if cmd == nil {
+		return
+	}
+
+	pack := server.NewDataPack(cmd.Op)
+	pack.SetMsgId(cmd.MsgId)
+	switch cmd.Op {
+	case "price":
+		pack.PushData(cmd.Args[0], "1.5")
+	case "list":
+		pack.Multi()
+		pack.PushData("BTC", "1.5")
+		pack.PushData("ETH", "0.5")
+	default:
+		return
+	}
+
+	r.GetConnection().SendMsg(pack.Pack())
+}
+
+// Fatalf之后退出当前协程, 和testing.T一样不再往下执行
+type recordTB struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recordTB) Helper() {}
+
+func (r *recordTB) Fatalf(format string, args ...interface{}) {
+	r.failed = true
+	runtime.Goexit()
+}
+
+func fails(fn func(tb testing.TB)) bool {
+	tb := &recordTB{}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		fn(tb)
+	}()
+	<-done
+
+	return tb.failed
+}
+
+func TestServerCall(t *testing.T) {
+	s := NewServer(testHandler)
+	defer s.Close()
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	frame, err := client.Call("price", "BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertFrame(t, frame.Raw, "price", "BTC", "1.5")
+}
+
+func TestServerPipe(t *testing.T) {
+	s := NewUnstartedServer(testHandler)
+	defer s.Close()
+
+	client, conn := s.Pipe()
+	defer client.Close()
+	if conn == nil {
+		t.Fatal("pipe conn rejected")
+	}
+
+	msgId, err := client.Send("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertRows(t, frame.Raw, "list", [][]string{{"BTC", "1.5"}, {"ETH", "0.5"}})
+	AssertMsgId(t, frame, msgId)
+}
+
+func TestFakeConn(t *testing.T) {
+	conn := NewFakeConn(1)
+	Do(testHandler, conn, "price", "7", "BTC")
+
+	frame := AssertFrame(t, conn.LastFrame(t).Raw, "price", "BTC", "1.5")
+	AssertMsgId(t, frame, "7")
+
+	conn.SetMsgHandler(testHandler)
+	conn.Receive(EncodeCmd("list", "8")[server.PackHeadLen:])
+	if frames := conn.Frames(t); len(frames) != 2 || len(frames[1].Rows) != 2 {
+		t.Fatalf("got %d frames, want price and list", len(frames))
+	}
+
+	conn.Reset()
+	conn.Stop()
+	if err := conn.SendMsg(EncodeCmd("price", "")); err == nil {
+		t.Fatal("SendMsg after Stop returned nil")
+	}
+
+	if len(conn.Sent()) != 0 {
+		t.Fatal("frames recorded after Reset and Stop")
+	}
+}
+
+// 不匹配时断言要失败
+func TestAssertMismatch(t *testing.T) {
+	b := server.EncodeCmd("price", "7", "BTC")
+	cases := map[string]func(tb testing.TB){
+		"op":     func(tb testing.TB) { AssertOp(tb, b, "list") },
+		"values": func(tb testing.TB) { AssertFrame(tb, b, "price", "ETH") },
+		"rows":   func(tb testing.TB) { AssertRows(tb, b, "price", [][]string{{"BTC"}, {"ETH"}}) },
+		"msgId":  func(tb testing.TB) { AssertMsgId(tb, MustDecodeFrame(tb, b), "8") },
+		"decode": func(tb testing.TB) { MustDecodeFrame(tb, b[:2]) },
+	}
+
+	for name, fn := range cases {
+		if !fails(fn) {
+			t.Errorf("%s mismatch not reported", name)
+		}
+	}
+
+	if fails(func(tb testing.TB) { AssertFrame(tb, b, "price", "BTC") }) {
+		t.Error("matching frame reported as mismatch")
+	}
+}
+
+// 抓包回放到handler, 每个连接的回复和原来相同
+func TestReplayToHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kanna.cap")
+	recorder, err := server.NewRecorder(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewUnstartedServer(testHandler)
+	s.Recorder = recorder
+	client, conn := s.Pipe()
+	if _, err := client.Call("price", "BTC"); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	conn.Stop()
+	recorder.Close()
+
+	conns, err := ReplayToHandler([]string{path}, testHandler, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := conns[conn.GetID()]
+	if fake == nil || !fake.IsClosed() {
+		t.Fatalf("replayed conns %v, want conn %d closed", conns, conn.GetID())
+	}
+
+	AssertFrame(t, fake.LastFrame(t).Raw, "price", "BTC", "1.5")
+}
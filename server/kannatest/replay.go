@@ -0,0 +1,36 @@
+package kannatest
+
+import (
+	"github.com/kdays/kanna/server"
+)
+
+// 把抓包文件里客户端发来的帧依次交给handler, 每个原始连接对应一个FakeConn, handler同步执行
+func ReplayToHandler(paths []string, handler server.MsgHandler, speed float64) (map[int]*FakeConn, error) {
+	conns := make(map[int]*FakeConn)
+	getConn := func(id int) *FakeConn {
+		conn, ok := conns[id]
+		if !ok {
+			conn = NewFakeConn(id)
+			conn.SetMsgHandler(handler)
+			conn.Start()
+			conns[id] = conn
+		}
+
+		return conn
+	}
+
+	err := server.ReplayCapture(paths, speed, func(rec *server.CaptureRecord) error {
+		switch rec.Dir {
+		case server.CaptureOpen:
+			getConn(rec.ConnID)
+		case server.CaptureIn:
+			getConn(rec.ConnID).Receive(rec.Data)
+		case server.CaptureClose:
+			getConn(rec.ConnID).Stop()
+		}
+
+		return nil
+	})
+
+	return conns, err
+}
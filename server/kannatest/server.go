@@ -0,0 +1,124 @@
+package kannatest
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kdays/kanna/server"
+)
+
+const DefaultTimeout = time.Second * 5
+
+type Server struct {
+	*server.KannaServer
+	Addr string
+
+	handler  server.MsgHandler
+	listener net.Listener
+}
+
+// 监听127.0.0.1上的随机端口
+func NewServer(handler server.MsgHandler) *Server {
+	s := NewUnstartedServer(handler)
+	s.Start()
+
+	return s
+}
+
+// Start之前可以先修改KannaServer的配置
+func NewUnstartedServer(handler server.MsgHandler) *Server {
+	return &Server{
+		KannaServer: server.NewKananServer(),
+		handler:     handler,
+	}
+}
+
+func (s *Server) Start() {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("kannatest: listen err %v", err))
+	}
+
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	go s.Serve(listener, s.handler)
+}
+
+func (s *Server) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	s.CloseAllConn()
+}
+
+func (s *Server) Dial() (*Client, error) {
+	conn, err := net.Dial("tcp4", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+// 不经过网络, 服务端那一侧通过ServeConn接管, 不需要Start
+func (s *Server) Pipe() (*Client, server.IKannaConnBehavior) {
+	clientConn, serverConn := net.Pipe()
+	conn := s.ServeConn(serverConn, s.handler)
+
+	return NewClient(clientConn), conn
+}
+
+type Client struct {
+	*server.KannaClient
+	Timeout time.Duration
+}
+
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		KannaClient: server.NewKannaClient(conn),
+		Timeout:     DefaultTimeout,
+	}
+}
+
+func (c *Client) SendRaw(b []byte) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	return c.KannaClient.SendRaw(b)
+}
+
+// 自动生成msgId并返回
+func (c *Client) Send(op string, args ...string) (string, error) {
+	msgId := c.NextMsgId()
+	return msgId, c.SendRaw(EncodeCmd(op, msgId, args...))
+}
+
+func (c *Client) ReadFrame() (*Frame, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	return c.KannaClient.ReadFrame()
+}
+
+// 分块回复拼成一帧再返回, 超时时间对整个回复生效
+func (c *Client) ReadMessage() (*Frame, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	return c.KannaClient.ReadMessage()
+}
+
+// 发送并等待msgId对应的回复, 中间收到的其他帧丢弃
+func (c *Client) Call(op string, args ...string) (*Frame, error) {
+	msgId, err := c.Send(op, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		frame, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		if frame.MsgId == msgId {
+			return frame, nil
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net"
+)
+
+func NewKannaNetConnection(server *KannaServer, ID int, conn net.Conn, handler MsgHandler) *KannaNetConnection {
+	c := &KannaNetConnection{
+		sKannaConnection: newKannaConnection(server, ID, conn, handler),
+		Conn:             conn,
+	}
+
+	c.Server.AddConn(c)
+	return c
+}
+
+func (c *KannaNetConnection) SendMsg(data []byte) error {
+	return c.send(c, data)
+}
+
+func (c *KannaNetConnection) SendReliable(data []byte) (uint64, error) {
+	return c.sendReliable(c, data)
+}
+
+func (c *KannaNetConnection) Start() {
+	c.start(c, c.Conn)
+}
+
+func (c *KannaNetConnection) Stop() {
+	c.stop(c, c.Conn)
+}
@@ -0,0 +1,18 @@
+module github.com/kdays/kanna/server/oteltrace
+
+go 1.18
+
+require (
+	github.com/kdays/kanna/server v0.0.0-20261019165737-7eaee3507221
+	go.opentelemetry.io/otel v1.14.0
+	go.opentelemetry.io/otel/sdk v1.14.0
+	go.opentelemetry.io/otel/trace v1.14.0
+)
+
+require (
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/shopspring/decimal v1.2.0 // indirect
+	golang.org/x/sys v0.5.0 // indirect
+)
@@ -0,0 +1,63 @@
+// 把server.Span导出到OpenTelemetry, 单独一个module, server本身不依赖OpenTelemetry
+//
+//	s.SpanExporter = oteltrace.NewExporter(otel.GetTracerProvider())
+//
+// go.mod依赖发布过的server版本, 本地同时改两边时在server目录建go.work:
+//
+//	go work init . ./oteltrace
+//	go work edit -replace github.com/kdays/kanna/server@<go.mod里的版本>=./
+package oteltrace
+
+import (
+	"context"
+	"time"
+
+	"github.com/kdays/kanna/server"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/kdays/kanna/server"
+
+// 每个帧一个名为 kanna <op> 的span, 下面按阶段分为read, wait, handle, write四个子span
+// 帧里没有上游的trace context, 每个帧都是新的trace
+type Exporter struct {
+	tracer trace.Tracer
+}
+
+func NewExporter(tp trace.TracerProvider) *Exporter {
+	return &Exporter{tracer: tp.Tracer(tracerName)}
+}
+
+func (e *Exporter) ExportSpan(s *server.Span) {
+	end := s.HandleEnd
+	if !s.WriteEnd.IsZero() {
+		end = s.WriteEnd
+	}
+
+	ctx, root := e.tracer.Start(context.Background(), "kanna "+s.Op,
+		trace.WithTimestamp(s.ReadStart),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.Int("kanna.conn_id", s.ConnID),
+			attribute.String("kanna.op", s.Op),
+			attribute.String("kanna.msg_id", s.MsgId),
+			attribute.Int("kanna.replies", s.Replies),
+		))
+
+	e.stage(ctx, "read", s.ReadStart, s.ReadEnd)
+	e.stage(ctx, "wait", s.ReadEnd, s.HandleStart)
+	e.stage(ctx, "handle", s.HandleStart, s.HandleEnd)
+
+	// 没有回复或者连接已经断开时没有write
+	if !s.WriteEnd.IsZero() {
+		e.stage(ctx, "write", s.HandleEnd, s.WriteEnd)
+	}
+
+	root.End(trace.WithTimestamp(end))
+}
+
+func (e *Exporter) stage(ctx context.Context, name string, start, end time.Time) {
+	_, span := e.tracer.Start(ctx, name, trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(end))
+}
@@ -0,0 +1,85 @@
+package oteltrace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kdays/kanna/server"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestExportSpan(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	start := time.Now()
+	span := &server.Span{
+		ConnID:      7,
+		Op:          "order",
+		MsgId:       "12",
+		ReadStart:   start,
+		ReadEnd:     start.Add(time.Millisecond),
+		HandleStart: start.Add(time.Millisecond * 2),
+		HandleEnd:   start.Add(time.Millisecond * 5),
+		WriteEnd:    start.Add(time.Millisecond * 6),
+		Replies:     1,
+	}
+	NewExporter(tp).ExportSpan(span)
+
+	ended := rec.Ended()
+	if len(ended) != 5 {
+		t.Fatalf("got %d spans, want 5", len(ended))
+	}
+
+	// 子span先结束
+	root := ended[4]
+	if root.Name() != "kanna order" || !root.StartTime().Equal(span.ReadStart) || !root.EndTime().Equal(span.WriteEnd) {
+		t.Fatalf("root %s %s-%s", root.Name(), root.StartTime(), root.EndTime())
+	}
+
+	want := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"read", span.ReadStart, span.ReadEnd},
+		{"wait", span.ReadEnd, span.HandleStart},
+		{"handle", span.HandleStart, span.HandleEnd},
+		{"write", span.HandleEnd, span.WriteEnd},
+	}
+
+	for i, w := range want {
+		got := ended[i]
+		if got.Name() != w.name || !got.StartTime().Equal(w.start) || !got.EndTime().Equal(w.end) {
+			t.Errorf("span %d: got %s %s-%s, want %s %s-%s", i, got.Name(), got.StartTime(), got.EndTime(), w.name, w.start, w.end)
+		}
+
+		if got.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("span %s is not a child of the frame span", got.Name())
+		}
+	}
+}
+
+// 没有回复时没有write, 整个span在handler结束时结束
+func TestExportSpanNoReply(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	start := time.Now()
+	NewExporter(tp).ExportSpan(&server.Span{
+		Op:          "sub",
+		ReadStart:   start,
+		ReadEnd:     start,
+		HandleStart: start,
+		HandleEnd:   start.Add(time.Millisecond),
+	})
+
+	ended := rec.Ended()
+	if len(ended) != 4 {
+		t.Fatalf("got %d spans, want 4", len(ended))
+	}
+
+	if root := ended[3]; !root.EndTime().Equal(start.Add(time.Millisecond)) {
+		t.Fatalf("root ended at %s", root.EndTime())
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
 )
 
@@ -47,57 +47,65 @@ func (p *DataPack) PushData(vals ...interface{}) {
 }
 
 func (p *DataPack) Pack() []byte {
-	msgFooter := ""
-	if p.sMsgId != "" {
-		msgFooter = p.sMsgId
-	}
+	return p.AppendPack(nil)
+}
 
-	var txt string
+// 把打包好的帧追加到dst后面, 复用dst可以避免每次分配
+func (p *DataPack) AppendPack(dst []byte) []byte {
+	buf := getPackBuffer()
+	defer putPackBuffer(buf)
+
+	buf.WriteString(p.Op)
+	buf.WriteByte('{')
 	if p.bMulti {
-		s := p.Op + "{"
 		for k, v := range p.Data {
-			sMap := []string{}
-			for _, vv := range v.([]interface{}) {
-				sMap = append(sMap, toStr(vv))
+			for kk, vv := range v.([]interface{}) {
+				if kk > 0 {
+					buf.WriteByte('\t')
+				}
+				writeValue(buf, vv)
 			}
 
-			s += strings.Join(sMap, "\t")
 			if len(p.Data)-1 != k {
-				s += "\n"
+				buf.WriteByte('\n')
 			}
 		}
-
-		txt = s + "}" + msgFooter
 	} else {
-		sMap := []string{}
-		for _, v := range p.Data {
-			sMap = append(sMap, toStr(v))
+		for k, v := range p.Data {
+			if k > 0 {
+				buf.WriteByte('\t')
+			}
+			writeValue(buf, v)
 		}
-
-		txt = p.Op + "{" + strings.Join(sMap, "\t") + "}" + msgFooter
 	}
+	buf.WriteByte('}')
+	buf.WriteString(p.sMsgId)
+	buf.WriteByte('\n')
 
-	txt = txt + "\n"
-	var res []byte
-	for _, v := range txt {
-		if v == 0 { // why fill \u0000？
-			continue
-		}
-		res = append(res, byte(v))
-	}
+	head := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	dst = append(dst, buf.Bytes()...)
 
-	dataBuff := bytes.NewBuffer([]byte{})
-	if err := binary.Write(dataBuff, binary.BigEndian, uint32(len(res))); err != nil {
-		log.Println(err)
-		return []byte{}
-	}
+	binary.BigEndian.PutUint32(dst[head:], uint32(len(dst)-head-PackHeadLen))
+	return dst
+}
 
-	if err := binary.Write(dataBuff, binary.BigEndian, res); err != nil {
-		log.Println(err)
-		return []byte{}
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	var tmp [20]byte
+	switch val := v.(type) {
+	case string:
+		buf.WriteString(val)
+	case int:
+		buf.Write(strconv.AppendInt(tmp[:0], int64(val), 10))
+	case int64:
+		buf.Write(strconv.AppendInt(tmp[:0], val, 10))
+	case uint64:
+		buf.Write(strconv.AppendUint(tmp[:0], val, 10))
+	case Binary:
+		val.writeTo(buf)
+	default:
+		fmt.Fprint(buf, v)
 	}
-
-	return dataBuff.Bytes()
 }
 
 type OpCmd struct {
@@ -106,17 +114,14 @@ type OpCmd struct {
 	Args  []string
 }
 
+// 数据来自客户端, 格式不对时返回nil, 不能panic也不打日志
+// 参数里可能有}, 所以按最后一个}切分, msgId里不会有}
 func ParseOp(b []byte) *OpCmd {
-	s := strings.TrimSpace(string(b[:]))
+	s := strings.TrimSpace(string(b))
 	begin := strings.Index(s, "{")
-	end := strings.Index(s, "}")
-
-	if end < begin {
-		log.Println("sth maybe wrong, end < begin", s)
-		return nil
-	}
+	end := strings.LastIndex(s, "}")
 
-	if begin == -1 || end == -1 {
+	if begin == -1 || end < begin {
 		return nil
 	}
 
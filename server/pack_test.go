@@ -0,0 +1,186 @@
+package server
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ecoin.OrderStatusMaps里的中文状态
+var orderStatusTexts = []string{"等待交易", "部分交易", "交易完成", "等待取消", "部分取消", "取消完成"}
+
+func TestPackUTF8RoundTrip(t *testing.T) {
+	for i, status := range orderStatusTexts {
+		pack := NewDataPack("order")
+		pack.SetMsgId("9")
+		pack.PushData(i, status)
+
+		cmd := ParseOp(pack.Pack()[PackHeadLen:])
+		if cmd == nil {
+			t.Fatalf("ParseOp failed for %q", status)
+		}
+
+		want := strconv.Itoa(i) + "\t" + status
+		if cmd.Op != "order" || cmd.MsgId != "9" || len(cmd.Args) != 1 || cmd.Args[0] != want {
+			t.Errorf("got %+v, want arg %q", cmd, want)
+		}
+	}
+}
+
+func TestPackMultiUTF8(t *testing.T) {
+	statuses := orderStatusTexts
+
+	pack := NewDataPack("orders")
+	pack.Multi()
+	for i, status := range statuses {
+		pack.PushData(i, status)
+	}
+
+	frame, err := DecodeFrame(pack.Pack(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(frame.Rows) != len(statuses) {
+		t.Fatalf("got %d rows, want %d", len(frame.Rows), len(statuses))
+	}
+
+	for i, row := range frame.Rows {
+		if want := []string{strconv.Itoa(i), statuses[i]}; !reflect.DeepEqual(row, want) {
+			t.Errorf("row %d: got %q, want %q", i, row, want)
+		}
+	}
+}
+
+// 以前Pack会去掉NUL
+func TestPackKeepsNUL(t *testing.T) {
+	pack := NewDataPack("raw")
+	pack.PushData("a\x00b", "\x00")
+
+	frame, err := DecodeFrame(pack.Pack(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"a\x00b", "\x00"}; !reflect.DeepEqual(frame.Values(), want) {
+		t.Fatalf("got %q, want %q", frame.Values(), want)
+	}
+}
+
+// 客户端发来的任意数据, 不能panic, 解析出来的结构要和原文一致
+func FuzzParseOp(f *testing.F) {
+	f.Add([]byte("order{BTC-USDT,buy,43210.5}12\n"))
+	f.Add([]byte("ping{}"))
+	f.Add([]byte("a{b}c}d{e"))
+	f.Add([]byte("}{"))
+	f.Add([]byte("{"))
+	f.Add([]byte(""))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cmd := ParseOp(b)
+		if cmd == nil {
+			return
+		}
+
+		s := strings.TrimSpace(string(b))
+		if strings.Contains(cmd.Op, "{") {
+			t.Fatalf("op %q contains {", cmd.Op)
+		}
+
+		if strings.Contains(cmd.MsgId, "}") {
+			t.Fatalf("msgId %q contains }", cmd.MsgId)
+		}
+
+		if !strings.HasPrefix(s, cmd.Op+"{"+strings.Join(cmd.Args, ",")+"}") {
+			t.Fatalf("parsed %+v does not match %q", cmd, s)
+		}
+	})
+}
+
+// Pack之后按客户端的方式解出来, 值要原样保留
+// 格式本身不能表达的输入跳过: op里有{, 值里有\t或\n, msgId里有}或\n, 首尾有空白
+func FuzzDataPackRoundTrip(f *testing.F) {
+	f.Add("order", "12", "BTC-USDT", "已成交")
+	f.Add("ticker", "", "a,b", "x}y")
+	f.Add("bin", "7", "\x00\x01", "")
+
+	f.Fuzz(func(t *testing.T, op, msgId, a, b string) {
+		if op == "" || strings.Contains(op, "{") || strings.TrimSpace(op) != op {
+			t.Skip()
+		}
+
+		if strings.ContainsAny(msgId, "}\n") || strings.TrimSpace(msgId) != msgId {
+			t.Skip()
+		}
+
+		if strings.ContainsAny(a+b, "\t\n") {
+			t.Skip()
+		}
+
+		pack := NewDataPack(op)
+		pack.SetMsgId(msgId)
+		pack.PushData(a, b)
+
+		frame, err := DecodeFrame(pack.Pack(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Op != op || frame.MsgId != msgId {
+			t.Fatalf("got op %q msgId %q, want %q %q", frame.Op, frame.MsgId, op, msgId)
+		}
+
+		if want := []string{a, b}; !reflect.DeepEqual(frame.Values(), want) {
+			t.Fatalf("got values %q, want %q", frame.Values(), want)
+		}
+	})
+}
+
+func benchOrderPack() *DataPack {
+	pack := NewDataPack("order")
+	pack.SetMsgId("123")
+	pack.PushData(int64(10001), "BTC-USDT", "buy", "43210.5", 3, "已成交")
+
+	return pack
+}
+
+// go test -bench Pack -benchmem
+func BenchmarkPack(b *testing.B) {
+	pack := benchOrderPack()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pack.Pack()
+	}
+}
+
+func BenchmarkAppendPack(b *testing.B) {
+	pack := benchOrderPack()
+	var dst []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = pack.AppendPack(dst[:0])
+	}
+}
+
+func BenchmarkPackMulti(b *testing.B) {
+	var dst []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pack := NewDataPack("orders")
+		pack.SetMsgId("123")
+		pack.Multi()
+		for j := 0; j < 50; j++ {
+			pack.PushData(int64(10001+j), "BTC-USDT", "buy", "43210.5", j)
+		}
+		dst = pack.AppendPack(dst[:0])
+	}
+}
+
+func BenchmarkParseOp(b *testing.B) {
+	data := []byte("order{BTC-USDT,buy,43210.5,3}123\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseOp(data)
+	}
+}
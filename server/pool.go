@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+)
+
+// 读缓冲大小, 足够放下一个完整的帧
+const ReadBufferSize = 4096
+
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+var requestPool = sync.Pool{
+	New: func() interface{} {
+		return &Request{}
+	},
+}
+
+var packBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer(n int) *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if buf == nil || cap(*buf) > maxPooledBufferSize {
+		return
+	}
+
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
+}
+
+func getRequest(conn IKannaConnBehavior, data []byte) *Request {
+	req := requestPool.Get().(*Request)
+	req.conn = conn
+	req.msg = data
+
+	return req
+}
+
+func putRequest(req *Request) {
+	req.conn = nil
+	req.msg = nil
+	requestPool.Put(req)
+}
+
+func getPackBuffer() *bytes.Buffer {
+	buf := packBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	return buf
+}
+
+func putPackBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	packBufferPool.Put(buf)
+}
+
+// 交给MsgHandler处理, 返回后回收Request和读缓冲, buf为nil表示data不是从池里取的
+func (c *sKannaConnection) dispatch(conn IKannaConnBehavior, buf *[]byte, data []byte, span *Span) {
+	handler := c.getMsgHandler()
+	if handler == nil {
+		putBuffer(buf)
+		return
+	}
+
+	req := getRequest(conn, data)
+	if c.Server.SerialDispatch {
+		c.beginSpan(span)
+		handler(req)
+		c.endSpan(span)
+		putRequest(req)
+		putBuffer(buf)
+		return
+	}
+
+	go func() {
+		c.beginSpan(span)
+		handler(req)
+		c.endSpan(span)
+		putRequest(req)
+		putBuffer(buf)
+	}()
+}
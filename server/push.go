@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// 取消推送 cancel{msgId}, 回复 cancel{ok\tmsgId}
+// 只有参数对应这个连接上正在推送的msgId时才会拦截, 其他的cancel照常交给MsgHandler
+const OpCancel = "cancel"
+
+// 绑定到请求msgId的长期推送, 收到cancel{msgId}, 连接断开或者发送失败时结束
+type PushStream struct {
+	Op    string
+	MsgId string
+
+	conn   IKannaConnBehavior
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type pushRegistry interface {
+	addPush(s *PushStream)
+	removePush(s *PushStream)
+}
+
+// 在新协程里执行fn, fn返回或者推送被取消后自动清理
+// Request在handler返回后会被回收, fn里不要再使用r
+func (r *Request) Stream(op string, fn func(s *PushStream)) *PushStream {
+	msgId := ""
+	if cmd := ParseOp(r.GetData()); cmd != nil {
+		msgId = cmd.MsgId
+		if op == "" {
+			op = cmd.Op
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &PushStream{
+		Op:     op,
+		MsgId:  msgId,
+		conn:   r.GetConnection(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	reg, _ := s.conn.(pushRegistry)
+	if reg != nil {
+		reg.addPush(s)
+	}
+
+	go func() {
+		defer func() {
+			s.cancel()
+			if reg != nil {
+				reg.removePush(s)
+			}
+		}()
+
+		fn(s)
+	}()
+
+	return s
+}
+
+func (s *PushStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *PushStream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+func (s *PushStream) IsDone() bool {
+	return s.ctx.Err() != nil
+}
+
+func (s *PushStream) Cancel() {
+	s.cancel()
+}
+
+func (s *PushStream) GetConnection() IKannaConnBehavior {
+	return s.conn
+}
+
+// 发送一行 op{vals}msgId
+func (s *PushStream) Send(vals ...interface{}) error {
+	pack := NewDataPack(s.Op)
+	pack.SetMsgId(s.MsgId)
+	pack.PushData(vals...)
+
+	return s.SendMsg(pack.Pack())
+}
+
+func (s *PushStream) SendMsg(data []byte) error {
+	if s.IsDone() {
+		return s.ctx.Err()
+	}
+
+	err := s.conn.SendMsg(data)
+	if err != nil {
+		s.cancel()
+	}
+
+	return err
+}
+
+// 每隔interval调用一次fn, 推送结束或者fn返回error时返回
+func (s *PushStream) Every(interval time.Duration, fn func() error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.Done():
+			return s.ctx.Err()
+		case <-ticker.C:
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 同一个msgId只保留最新的推送
+func (c *sKannaConnection) addPush(s *PushStream) {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+
+	if c.pushes == nil {
+		c.pushes = make(map[string]*PushStream)
+	}
+
+	if old, ok := c.pushes[s.MsgId]; ok {
+		old.cancel()
+	}
+
+	c.pushes[s.MsgId] = s
+
+	// 注册时连接已经断开
+	if c.IsClosed() {
+		s.cancel()
+	}
+}
+
+func (c *sKannaConnection) removePush(s *PushStream) {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+
+	if c.pushes[s.MsgId] == s {
+		delete(c.pushes, s.MsgId)
+	}
+}
+
+func (c *sKannaConnection) hasPushes() bool {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+
+	return len(c.pushes) > 0
+}
+
+func (c *sKannaConnection) cancelAllPushes() {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+
+	for _, s := range c.pushes {
+		s.cancel()
+	}
+	c.pushes = nil
+}
+
+// 返回false表示不是取消推送, 交给MsgHandler
+func (c *sKannaConnection) handleCancel(conn IKannaConnBehavior, cmd *OpCmd) bool {
+	if len(cmd.Args) == 0 {
+		return false
+	}
+
+	target := cmd.Args[0]
+	c.pushLock.Lock()
+	s, ok := c.pushes[target]
+	if ok {
+		delete(c.pushes, target)
+	}
+	c.pushLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	s.cancel()
+
+	reply := NewDataPack(OpCancel)
+	reply.SetMsgId(cmd.MsgId)
+	reply.PushData("ok", target)
+	conn.SendMsg(reply.Pack())
+	return true
+}
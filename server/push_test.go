@@ -0,0 +1,119 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// sub开始每5ms推送一次tick, 其他op发到ops
+func pushClient(t *testing.T, s *KannaServer) (IKannaConnBehavior, *KannaClient, chan *PushStream, chan string) {
+	streams := make(chan *PushStream, 4)
+	ops := make(chan string, 4)
+	conn, client := pipeClient(t, s, func(r *Request) {
+		cmd := ParseOp(r.GetData())
+		if cmd.Op != "sub" {
+			ops <- cmd.Op
+			return
+		}
+
+		streams <- r.Stream("tick", func(s *PushStream) {
+			s.Every(time.Millisecond*5, func() error {
+				return s.Send("1")
+			})
+		})
+	})
+
+	return conn, client, streams, ops
+}
+
+func waitDone(t *testing.T, s *PushStream) {
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("push stream not done")
+	}
+}
+
+func waitNoPushes(t *testing.T, conn IKannaConnBehavior) {
+	c := conn.(*KannaNetConnection)
+	deadline := time.Now().Add(time.Second)
+	for c.hasPushes() {
+		if time.Now().After(deadline) {
+			t.Fatal("pushes not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPushCancel(t *testing.T) {
+	conn, client, streams, ops := pushClient(t, NewKananServer())
+	msgId, err := client.Send("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := <-streams
+	if frame := readOp(t, client, "tick"); frame.MsgId != msgId {
+		t.Fatalf("tick msgId %s, want %s", frame.MsgId, msgId)
+	}
+
+	// 不是正在推送的msgId, 交给MsgHandler
+	if _, err := client.Send(OpCancel, "nope"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case op := <-ops:
+		if op != OpCancel {
+			t.Fatalf("handler got %s, want %s", op, OpCancel)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unknown cancel not passed to MsgHandler")
+	}
+
+	if _, err := client.Send(OpCancel, msgId); err != nil {
+		t.Fatal(err)
+	}
+	if vals := readOp(t, client, OpCancel).Values(); vals[0] != "ok" || vals[1] != msgId {
+		t.Fatalf("cancel reply %q", vals)
+	}
+
+	waitDone(t, s)
+	waitNoPushes(t, conn)
+}
+
+// 同一个msgId再次推送时取消旧的
+func TestPushReplaceSameMsgId(t *testing.T) {
+	conn, client, streams, _ := pushClient(t, NewKananServer())
+	if _, err := client.SendLine("sub{}7"); err != nil {
+		t.Fatal(err)
+	}
+	first := <-streams
+
+	if _, err := client.SendLine("sub{}7"); err != nil {
+		t.Fatal(err)
+	}
+	second := <-streams
+
+	waitDone(t, first)
+	if second.IsDone() {
+		t.Fatal("new push cancelled")
+	}
+
+	second.Cancel()
+	waitDone(t, second)
+	waitNoPushes(t, conn)
+}
+
+func TestPushStopsOnDisconnect(t *testing.T) {
+	conn, client, streams, _ := pushClient(t, NewKananServer())
+	if _, err := client.Send("sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := <-streams
+	readOp(t, client, "tick")
+	client.Close()
+
+	waitDone(t, s)
+	waitNoPushes(t, conn)
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 抓包记录的方向
+const CaptureIn = 1    // 客户端发来的帧体, 即MsgHandler拿到的数据
+const CaptureOut = 2   // SendMsg发出的完整帧, 压缩前
+const CaptureOpen = 3  // 连接建立
+const CaptureClose = 4 // 连接断开
+
+// 文件头: magic + 版本 + 起始时间(纳秒)
+var captureMagic = []byte("KNCAP")
+
+const captureVersion = 1
+
+const DefaultCaptureMaxSize = 64 << 20
+const DefaultCaptureMaxFiles = 5
+
+const maxCaptureRecordLen = 16 << 20
+
+type CaptureRecord struct {
+	Time   time.Time
+	ConnID int
+	Dir    int
+	Data   []byte
+}
+
+// 写入抓包文件, 每条记录为 方向 + 时间差 + 连接ID + 长度 + 数据, 数字都是uvarint
+// 超过MaxSize后轮转为 path.1 path.2 ..., 最多保留MaxFiles个旧文件
+type Recorder struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	last   int64
+	closed bool
+	close  chan bool
+	lock   sync.Mutex
+}
+
+func NewRecorder(path string, maxSize int64, maxFiles int) (*Recorder, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultCaptureMaxSize
+	}
+
+	if maxFiles < 0 {
+		maxFiles = DefaultCaptureMaxFiles
+	}
+
+	r := &Recorder{
+		Path:     path,
+		MaxSize:  maxSize,
+		MaxFiles: maxFiles,
+		close:    make(chan bool),
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	go r.flushLoop()
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	f, err := os.OpenFile(r.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	r.file = f
+	r.writer = bufio.NewWriterSize(f, 64*1024)
+	r.last = time.Now().UnixNano()
+
+	head := make([]byte, len(captureMagic)+1+8)
+	copy(head, captureMagic)
+	head[len(captureMagic)] = captureVersion
+	binary.BigEndian.PutUint64(head[len(captureMagic)+1:], uint64(r.last))
+
+	n, err := r.writer.Write(head)
+	r.size = int64(n)
+	return err
+}
+
+func (r *Recorder) rotate() error {
+	r.writer.Flush()
+	r.file.Close()
+
+	if r.MaxFiles == 0 {
+		os.Remove(r.Path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.Path, r.MaxFiles))
+		for i := r.MaxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+		}
+		os.Rename(r.Path, r.Path+".1")
+	}
+
+	return r.open()
+}
+
+func (r *Recorder) Record(dir int, connID int, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	if r.size >= r.MaxSize {
+		if err := r.rotate(); err != nil {
+			log.Println("capture rotate err", err)
+			r.closed = true
+			return
+		}
+	}
+
+	now := time.Now().UnixNano()
+	delta := now - r.last
+	if delta < 0 {
+		delta = 0
+	}
+	r.last += delta
+
+	var head [1 + binary.MaxVarintLen64*3]byte
+	head[0] = byte(dir)
+	n := 1
+	n += binary.PutUvarint(head[n:], uint64(delta))
+	n += binary.PutUvarint(head[n:], uint64(connID))
+	n += binary.PutUvarint(head[n:], uint64(len(data)))
+
+	r.writer.Write(head[:n])
+	r.writer.Write(data)
+	r.size += int64(n + len(data))
+}
+
+func (r *Recorder) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	return r.writer.Flush()
+}
+
+func (r *Recorder) flushLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Flush()
+		case <-r.close:
+			return
+		}
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+	close(r.close)
+	r.writer.Flush()
+
+	return r.file.Close()
+}
+
+type CaptureReader struct {
+	reader *bufio.Reader
+	file   *os.File
+	last   int64
+}
+
+func OpenCapture(path string) (*CaptureReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &CaptureReader{
+		reader: bufio.NewReader(f),
+		file:   f,
+	}
+
+	head := make([]byte, len(captureMagic)+1+8)
+	if _, err := io.ReadFull(r.reader, head); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if string(head[:len(captureMagic)]) != string(captureMagic) || head[len(captureMagic)] != captureVersion {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a kanna capture file", path)
+	}
+
+	r.last = int64(binary.BigEndian.Uint64(head[len(captureMagic)+1:]))
+	return r, nil
+}
+
+// 读完返回io.EOF
+func (r *CaptureReader) Next() (*CaptureRecord, error) {
+	dir, err := r.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	delta, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	connID, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	size, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if size > maxCaptureRecordLen {
+		return nil, fmt.Errorf("capture record too large: %d", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	r.last += int64(delta)
+	return &CaptureRecord{
+		Time:   time.Unix(0, r.last),
+		ConnID: int(connID),
+		Dir:    int(dir),
+		Data:   data,
+	}, nil
+}
+
+func (r *CaptureReader) Close() error {
+	return r.file.Close()
+}
+
+// 按记录之间的时间间隔依次回调, speed为倍速, 0为不等待
+func ReplayCapture(paths []string, speed float64, fn func(rec *CaptureRecord) error) error {
+	var prev time.Time
+	for _, path := range paths {
+		r, err := OpenCapture(path)
+		if err != nil {
+			return err
+		}
+
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				r.Close()
+				return err
+			}
+
+			if speed > 0 && !prev.IsZero() && rec.Time.After(prev) {
+				time.Sleep(time.Duration(float64(rec.Time.Sub(prev)) / speed))
+			}
+			prev = rec.Time
+
+			if err := fn(rec); err != nil {
+				r.Close()
+				return err
+			}
+		}
+
+		r.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func readCapture(t *testing.T, paths ...string) (res []*CaptureRecord) {
+	err := ReplayCapture(paths, 0, func(rec *CaptureRecord) error {
+		res = append(res, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+// 记录一个连接的收发, 读回来的顺序和内容一致
+func TestRecorderRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kanna.cap")
+	r, err := NewRecorder(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewKananServer()
+	s.Recorder = r
+	conn, client := pipeClient(t, s, func(req *Request) {
+		req.GetConnection().SendMsg(EncodeCmd("pong", "1", "ok"))
+	})
+
+	if _, err := client.Send("ping", "a"); err != nil {
+		t.Fatal(err)
+	}
+	expectOp(t, client, "pong")
+
+	conn.Stop()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		dir int
+		op  string
+	}{
+		{CaptureOpen, ""},
+		{CaptureIn, "ping"},
+		{CaptureOut, "pong"},
+		{CaptureClose, ""},
+	}
+
+	recs := readCapture(t, path)
+	if len(recs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(recs), len(want))
+	}
+
+	for k, rec := range recs {
+		if rec.ConnID != conn.GetID() || rec.Dir != want[k].dir {
+			t.Fatalf("record %d: conn %d dir %d, want conn %d dir %d", k, rec.ConnID, rec.Dir, conn.GetID(), want[k].dir)
+		}
+
+		if k > 0 && rec.Time.Before(recs[k-1].Time) {
+			t.Fatalf("record %d time goes backwards", k)
+		}
+
+		if want[k].op == "" {
+			continue
+		}
+
+		// 收到的是帧体, 发出的是带包头的完整帧
+		data := rec.Data
+		if rec.Dir == CaptureOut {
+			data = data[PackHeadLen:]
+		}
+
+		if cmd := ParseOp(data); cmd == nil || cmd.Op != want[k].op {
+			t.Fatalf("record %d: got %q, want op %s", k, rec.Data, want[k].op)
+		}
+	}
+}
+
+// 超过MaxSize轮转, 只保留MaxFiles个旧文件, 按从旧到新读回是连续的
+func TestRecorderRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kanna.cap")
+	r, err := NewRecorder(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		r.Record(CaptureIn, 1, []byte(strconv.Itoa(i)+":"+strings.Repeat("x", 40)))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("%s.3 should not exist: %v", path, err)
+	}
+
+	recs := readCapture(t, path+".2", path+".1", path)
+	if len(recs) == 0 || len(recs) == 20 {
+		t.Fatalf("got %d records, want the oldest ones rotated away", len(recs))
+	}
+
+	index := func(rec *CaptureRecord) int {
+		n, _ := strconv.Atoi(strings.SplitN(string(rec.Data), ":", 2)[0])
+		return n
+	}
+
+	first := index(recs[0])
+	for k, rec := range recs {
+		if n := index(rec); n != first+k {
+			t.Fatalf("record %d is %d, want %d", k, n, first+k)
+		}
+	}
+
+	if first+len(recs) != 20 {
+		t.Fatalf("last record %d, want 19", first+len(recs)-1)
+	}
+}
+
+func TestOpenCaptureBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.cap")
+	if err := os.WriteFile(path, []byte("not a capture file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenCapture(path); err == nil {
+		t.Fatal("OpenCapture accepted a bad file")
+	}
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 客户端确认收到可靠帧 ack{seq,seq...}, 不回复
+const OpAck = "ack"
+
+// 包头长度的次高位表示可靠帧, 帧体前8字节为序号, 客户端需要ack
+const FrameFlagReliable uint32 = 1 << 30
+
+const frameFlagMask = FrameFlagCompressed | FrameFlagReliable | FrameFlagChunk
+
+const reliableSeqLen = 8
+
+const DefaultReliableAckTimeout = time.Second * 10
+const DefaultReliableMaxRetries = 3
+const DefaultReliableMaxUnacked = 1000
+
+type reliableFrame struct {
+	data    []byte
+	sent    time.Time // 最近一次发送的时间
+	retries int
+}
+
+type reliableQueue struct {
+	seq     uint64
+	unacked map[uint64]*reliableFrame
+	conn    IKannaConnBehavior // 最近发送用的连接, 超时重发时使用
+	timer   *time.Timer        // 有未确认的帧时等待下一次超时检查
+	lock    sync.Mutex
+}
+
+func newReliableQueue() *reliableQueue {
+	return &reliableQueue{
+		unacked: make(map[uint64]*reliableFrame),
+	}
+}
+
+func (q *reliableQueue) push(conn IKannaConnBehavior, data []byte, limit int) (uint64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.unacked) >= limit {
+		return 0, fmt.Errorf("too many unacked reliable frames")
+	}
+
+	q.seq++
+	q.unacked[q.seq] = &reliableFrame{data: data, sent: time.Now()}
+	q.conn = conn
+
+	return q.seq, nil
+}
+
+func (q *reliableQueue) ack(seq uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.unacked, seq)
+}
+
+func (q *reliableQueue) pending() []uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var res []uint64
+	for seq := range q.unacked {
+		res = append(res, seq)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+	return res
+}
+
+func (q *reliableQueue) get(seq uint64) ([]byte, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	f, ok := q.unacked[seq]
+	if !ok {
+		return nil, false
+	}
+
+	return f.data, true
+}
+
+// 重连后换到新的连接上, 重新开始计时, 返回所有未确认的序号
+func (q *reliableQueue) attach(conn IKannaConnBehavior) []uint64 {
+	q.lock.Lock()
+	q.conn = conn
+	now := time.Now()
+	for _, f := range q.unacked {
+		f.sent = now
+	}
+	q.lock.Unlock()
+
+	return q.pending()
+}
+
+// 清空并返回所有未确认的帧
+func (q *reliableQueue) drain() map[uint64][]byte {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+
+	res := make(map[uint64][]byte, len(q.unacked))
+	for seq, f := range q.unacked {
+		res[seq] = f.data
+	}
+	q.unacked = make(map[uint64]*reliableFrame)
+
+	return res
+}
+
+// 给已经Pack好的帧加上序号和可靠标记, 保留其他标记位
+func wrapReliable(seq uint64, data []byte) []byte {
+	if len(data) < PackHeadLen {
+		return data
+	}
+
+	msgLen := binary.BigEndian.Uint32(data[:PackHeadLen])
+	body := data[PackHeadLen:]
+	res := make([]byte, PackHeadLen+reliableSeqLen+len(body))
+	binary.BigEndian.PutUint32(res, uint32(reliableSeqLen+len(body))|FrameFlagReliable|msgLen&frameFlagMask)
+	binary.BigEndian.PutUint64(res[PackHeadLen:], seq)
+	copy(res[PackHeadLen+reliableSeqLen:], body)
+
+	return res
+}
+
+func (c *sKannaConnection) reliableQueue() *reliableQueue {
+	if sess := c.GetSession(); sess != nil {
+		return sess.reliable
+	}
+
+	return c.reliable
+}
+
+// 发送需要客户端确认的帧, 断线时保留到重连后重发, 最终失败时触发OnDeliveryFailed
+func (c *sKannaConnection) sendReliable(conn IKannaConnBehavior, data []byte) (uint64, error) {
+	if !c.Server.EnableReliable {
+		return 0, fmt.Errorf("reliable delivery disabled")
+	}
+
+	if !connSupports(conn, FeatureReliable) {
+		return 0, fmt.Errorf("client did not negotiate reliable delivery")
+	}
+
+	q := c.reliableQueue()
+	seq, err := q.push(conn, data, c.Server.reliableMaxUnacked())
+	if err != nil {
+		return 0, err
+	}
+
+	// 已经断开的session不走消息缓存, 重连后统一重发
+	if sess := c.GetSession(); conn.IsClosed() && sess != nil {
+		return seq, nil
+	}
+
+	if err := conn.SendMsg(wrapReliable(seq, data)); err != nil {
+		q.ack(seq)
+		return 0, err
+	}
+
+	c.Server.scheduleAckCheck(q)
+	return seq, nil
+}
+
+func (c *sKannaConnection) handleAck(cmd *OpCmd) {
+	q := c.reliableQueue()
+	for _, arg := range cmd.Args {
+		seq, err := strconv.ParseUint(strings.TrimSpace(arg), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		q.ack(seq)
+	}
+}
+
+// 重连后按序号重发所有未确认的帧, 客户端按序号去重
+// 新连接没有协商可靠投递时不能发带可靠标记的帧, 全部按失败处理
+func (c *sKannaConnection) retransmit(conn IKannaConnBehavior) {
+	q := c.reliableQueue()
+	if !connSupports(conn, FeatureReliable) {
+		c.Server.failDelivery(conn, q)
+		return
+	}
+
+	for _, seq := range q.attach(conn) {
+		if data, ok := q.get(seq); ok {
+			conn.SendMsg(wrapReliable(seq, data))
+		}
+	}
+
+	c.Server.scheduleAckCheck(q)
+}
+
+// 在最早的帧超时的时候检查, 连接已经断开时不检查, 由重连后的retransmit或者failDelivery处理
+func (c *KannaServer) scheduleAckCheck(q *reliableQueue) {
+	timeout := c.reliableAckTimeout()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.timer != nil || len(q.unacked) == 0 || q.conn == nil || q.conn.IsClosed() {
+		return
+	}
+
+	var next time.Time
+	for _, f := range q.unacked {
+		if deadline := f.sent.Add(timeout); next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+
+	q.timer = time.AfterFunc(time.Until(next), func() {
+		c.checkAcks(q)
+	})
+}
+
+// 超时没有ack的帧重发, 重发ReliableMaxRetries次之后放弃并触发OnDeliveryFailed
+func (c *KannaServer) checkAcks(q *reliableQueue) {
+	timeout := c.reliableAckTimeout()
+	maxRetries := c.reliableMaxRetries()
+	now := time.Now()
+
+	q.lock.Lock()
+	q.timer = nil
+	conn := q.conn
+	if conn == nil || conn.IsClosed() {
+		q.lock.Unlock()
+		return
+	}
+
+	var resend, failed []uint64
+	data := make(map[uint64][]byte)
+	for seq, f := range q.unacked {
+		if now.Sub(f.sent) < timeout {
+			continue
+		}
+
+		data[seq] = f.data
+		if f.retries >= maxRetries {
+			failed = append(failed, seq)
+			delete(q.unacked, seq)
+			continue
+		}
+
+		f.retries++
+		f.sent = now
+		resend = append(resend, seq)
+	}
+	q.lock.Unlock()
+
+	sort.Slice(resend, func(i, j int) bool { return resend[i] < resend[j] })
+	for _, seq := range resend {
+		conn.SendMsg(wrapReliable(seq, data[seq]))
+	}
+
+	if c.OnDeliveryFailed != nil {
+		sort.Slice(failed, func(i, j int) bool { return failed[i] < failed[j] })
+		for _, seq := range failed {
+			c.OnDeliveryFailed(conn, seq, data[seq])
+		}
+	}
+
+	c.scheduleAckCheck(q)
+}
+
+func (c *KannaServer) reliableAckTimeout() time.Duration {
+	if c.ReliableAckTimeout <= 0 {
+		return DefaultReliableAckTimeout
+	}
+
+	return c.ReliableAckTimeout
+}
+
+func (c *KannaServer) reliableMaxRetries() int {
+	if c.ReliableMaxRetries <= 0 {
+		return DefaultReliableMaxRetries
+	}
+
+	return c.ReliableMaxRetries
+}
+
+func (c *KannaServer) reliableMaxUnacked() int {
+	if c.ReliableMaxUnacked <= 0 {
+		return DefaultReliableMaxUnacked
+	}
+
+	return c.ReliableMaxUnacked
+}
+
+func (c *KannaServer) failDelivery(conn IKannaConnBehavior, q *reliableQueue) {
+	unacked := q.drain()
+	if c.OnDeliveryFailed == nil || len(unacked) == 0 {
+		return
+	}
+
+	var seqs []uint64
+	for seq := range unacked {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	for _, seq := range seqs {
+		c.OnDeliveryFailed(conn, seq, unacked[seq])
+	}
+}
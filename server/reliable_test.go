@@ -0,0 +1,181 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func reliableClient(t *testing.T, s *KannaServer) (IKannaConnBehavior, *KannaClient) {
+	s.EnableHello = true
+	s.EnableReliable = true
+
+	conn, client := pipeClient(t, s, nil)
+	if _, err := client.Hello(ProtocolVersion, nil, []string{FeatureReliable}); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, client
+}
+
+// 不ack时按超时重发, 次数用完后触发OnDeliveryFailed
+func TestReliableRetryThenFail(t *testing.T) {
+	s := NewKananServer()
+	s.ReliableAckTimeout = time.Millisecond * 50
+	s.ReliableMaxRetries = 2
+
+	failed := make(chan uint64, 1)
+	s.OnDeliveryFailed = func(conn IKannaConnBehavior, seq uint64, data []byte) {
+		failed <- seq
+	}
+
+	conn, client := reliableClient(t, s)
+	seq, err := conn.SendReliable(EncodeCmd("order", "", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次发送加两次重发
+	for i := 0; i < 3; i++ {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Seq != seq {
+			t.Fatalf("frame %d seq %d, want %d", i, frame.Seq, seq)
+		}
+	}
+
+	select {
+	case got := <-failed:
+		if got != seq {
+			t.Fatalf("OnDeliveryFailed seq %d, want %d", got, seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDeliveryFailed not called")
+	}
+}
+
+// ack之后不再重发
+func TestReliableAckStopsRetry(t *testing.T) {
+	s := NewKananServer()
+	s.ReliableAckTimeout = time.Millisecond * 50
+	s.OnDeliveryFailed = func(conn IKannaConnBehavior, seq uint64, data []byte) {
+		t.Errorf("OnDeliveryFailed called for %d", seq)
+	}
+
+	conn, client := reliableClient(t, s)
+	client.AutoAck = true
+	if _, err := conn.SendReliable(EncodeCmd("order", "", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if frame, err := client.ReadFrame(); err == nil {
+		t.Fatalf("got %+v after ack", frame)
+	}
+}
+
+func TestReliableMaxUnacked(t *testing.T) {
+	s := NewKananServer()
+	s.ReliableMaxUnacked = 2
+
+	conn, client := reliableClient(t, s)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.SendReliable(EncodeCmd("order", "", "1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := conn.SendReliable(EncodeCmd("order", "", "1")); err == nil {
+		t.Fatal("SendReliable over ReliableMaxUnacked returned nil")
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ack由服务端的读协程处理, 等它生效
+	if _, err := client.Send(OpAck, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := conn.SendReliable(EncodeCmd("order", "", "1"))
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("SendReliable after ack %d: %v", frame.Seq, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 分块帧走可靠投递时保留分块标记
+func TestWrapReliableKeepsFlags(t *testing.T) {
+	data := chunkFrame(ChunkContinue, 3, EncodeCmd("rows", "7", "a"))
+	frame, err := DecodeFrame(wrapReliable(9, data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame.Seq != 9 || frame.Chunk != ChunkContinue || frame.ChunkIndex != 3 || frame.Op != "rows" {
+		t.Fatalf("got seq %d chunk %d index %d op %s", frame.Seq, frame.Chunk, frame.ChunkIndex, frame.Op)
+	}
+}
+
+// resume的新连接没有协商可靠投递时不重发, 未确认的帧触发OnDeliveryFailed
+func TestRetransmitWithoutReliable(t *testing.T) {
+	s := NewKananServer()
+	s.EnableSession = true
+
+	failed := make(chan uint64, 1)
+	s.OnDeliveryFailed = func(conn IKannaConnBehavior, seq uint64, data []byte) {
+		failed <- seq
+	}
+
+	// session帧在hello之前, 已经被Hello跳过了
+	conn, first := reliableClient(t, s)
+	sess := conn.GetSession()
+	token := sess.Token
+	seq, err := conn.SendReliable(EncodeCmd("order", "", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOp(t, first, "order")
+
+	first.Close()
+	deadline := time.Now().Add(time.Second * 2)
+	for !sess.IsDetached() {
+		if time.Now().After(deadline) {
+			t.Fatal("session not detached after peer close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, second := pipeClient(t, s, nil)
+	readOp(t, second, OpSession)
+	if _, err := second.Send(OpResume, token); err != nil {
+		t.Fatal(err)
+	}
+	readOp(t, second, OpResume)
+
+	select {
+	case got := <-failed:
+		if got != seq {
+			t.Fatalf("OnDeliveryFailed seq %d, want %d", got, seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDeliveryFailed not called")
+	}
+
+	expectNothing(t, second)
+}
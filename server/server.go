@@ -4,25 +4,91 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type KannaServer struct {
-	ID            string
-	OnConnStart   func(conn IKannaConnBehavior)
-	OnConnEnd     func(conn IKannaConnBehavior)
-	connections   map[int]IKannaConnBehavior
-	SendCount     int
-	NeedSendCount bool
-	connLock      sync.RWMutex //读写连接的读写锁
+	ID             string
+	IDGenerator    IDGenerator                         // 连接ID生成器, 默认从1开始递增
+	OnConnStart    func(conn IKannaConnBehavior) error // 返回error时发送拒绝帧并关闭连接, 不会Start
+	OnConnEnd      func(conn IKannaConnBehavior)
+	connections    map[int]IKannaConnBehavior
+	SendCount      int
+	NeedSendCount  bool
+	sendCountLock  sync.Mutex
+	connLock       sync.RWMutex //读写连接的读写锁
+	MaxMsgLen      int          // 单帧最大长度, 超过直接断开, 0为DefaultMaxMsgLen
+	SerialDispatch bool         // 在读协程里按顺序调用MsgHandler, 不再每条消息开一个协程
+
+	EnableCompression bool // 响应客户端的压缩协商, 默认关闭
+	CompressThreshold int  // 超过该长度的帧才压缩, 0为DefaultCompressThreshold
+
+	EnableSession     bool          // 连接时下发session token, 断线后可以resume
+	SessionGrace      time.Duration // 断线后保留session的时间, 0为DefaultSessionGrace
+	SessionBufferSize int           // 断线期间最多缓存的消息数, 0为DefaultSessionBufferSize
+	sessions          map[string]*Session
+	sessionLock       sync.Mutex
+
+	WriteQueueSize int           // 每个连接的发送队列长度, 0为DefaultWriteQueueSize
+	WriteBatchSize int           // 一次writev最多合并的消息数, 1为不合并, 0为DefaultWriteBatchSize
+	WriteLatency   time.Duration // 合并时最多等待的时间, 0为只合并队列里已有的
+
+	EnableReliable   bool                                                   // 允许SendReliable, 需要EnableHello, 客户端hello协商reliable并回复ack
+	OnDeliveryFailed func(conn IKannaConnBehavior, seq uint64, data []byte) // 可靠帧最终没有送达
+
+	ReliableAckTimeout time.Duration // 超过这个时间没有ack就重发, 0为DefaultReliableAckTimeout
+	ReliableMaxRetries int           // 重发这么多次还没有ack就放弃, 0为DefaultReliableMaxRetries
+	ReliableMaxUnacked int           // 每个连接最多未确认的帧数, 超过时SendReliable返回错误, 0为DefaultReliableMaxUnacked
+
+	topics    map[string]map[int]IKannaConnBehavior
+	topicLock sync.RWMutex
+
+	OnGroupJoin  func(group *Group, conn IKannaConnBehavior)
+	OnGroupLeave func(group *Group, conn IKannaConnBehavior) // 主动退出, 连接断开, 分组被删除时都会触发
+	groups       map[string]*Group
+	groupLock    sync.RWMutex
+
+	cluster *Cluster
+
+	Recorder *Recorder // 不为nil时记录所有收发的帧, 需要在Listen之前设置
+
+	MaxConns      int                    // 最大连接数, 0为不限制
+	MaxConnsPerIP int                    // 单个IP的最大连接数, 0为不限制
+	RejectFrame   func(err error) []byte // 拒绝连接时发送的帧, 默认为reject{reason}, 返回nil不发送
+	admission     *admission
+
+	AllowTelnet bool         // 新连接默认的AllowTelnet
+	configPath  string       // WatchConfig加载的配置文件
+	configLock  sync.RWMutex // 保护可以热更新的配置
+	liveConfig  atomic.Value // *liveConfig, 读的时候不加锁
+
+	SpanExporter SpanExporter // 不为nil时记录每个帧的处理耗时, 需要在Listen之前设置
+
+	EnableHello        bool // 响应客户端的hello握手, 关闭时hello和其他op一样交给MsgHandler
+	MinProtocolVersion int  // hello握手时允许的最低版本, 0为不限制
+
+	EventLoops    int // ServeEventLoop使用的epoll协程数, 0为CPU数, 需要在ServeEventLoop之前设置
+	eventLoops    []*eventLoop
+	eventLoopNext uint32
+	eventLoopLock sync.Mutex
+
+	listeners    int32 // 正在accept的listener数, 原子读写
+	shuttingDown int32 // CloseAllConn之后为1
 }
 
-var GServId = 0
+const DefaultMaxMsgLen = 1000
 
 func NewKananServer() *KannaServer {
 	return &KannaServer{
+		IDGenerator: NewMonotonicIDGenerator(0),
 		connections: make(map[int]IKannaConnBehavior),
+		sessions:    make(map[string]*Session),
+		topics:      make(map[string]map[int]IKannaConnBehavior),
+		groups:      make(map[string]*Group),
+		admission:   newAdmission(),
 	}
 }
 
@@ -33,24 +99,83 @@ func (c *KannaServer) AddConn(conn IKannaConnBehavior) {
 	c.connections[conn.GetID()] = conn
 }
 
-func (c *KannaServer) Broadcast(msg []byte) {
+// 复制一份当前连接, 避免持锁发送
+func (c *KannaServer) GetConns() []IKannaConnBehavior {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+
+	res := make([]IKannaConnBehavior, 0, len(c.connections))
 	for _, conn := range c.connections {
+		res = append(res, conn)
+	}
+
+	return res
+}
+
+func (c *KannaServer) GetConn(id int) IKannaConnBehavior {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+
+	return c.connections[id]
+}
+
+func (c *KannaServer) Broadcast(msg []byte) {
+	c.broadcastLocal(msg)
+
+	if c.cluster != nil {
+		c.cluster.forwardBroadcast(msg)
+	}
+}
+
+func (c *KannaServer) broadcastLocal(msg []byte) {
+	for _, conn := range c.GetConns() {
 		conn.SendMsg(msg)
 	}
+
+	// 等待重连的session也要收到
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	for _, sess := range c.sessions {
+		sess.buffer(nil, msg)
+	}
 }
 
+// 本地没有该连接时转发给集群里的其他节点
 func (c *KannaServer) SendMsg(id int, msg []byte) {
-	c.connections[id].SendMsg(msg)
+	if c.sendLocal(id, msg) {
+		return
+	}
+
+	if c.cluster != nil {
+		c.cluster.forwardSend(id, msg)
+	}
 }
 
-func (c *KannaServer) CloseAllConn() {
-	for {
-		if len(c.connections) < 1 {
-			return
-		}
+func (c *KannaServer) sendLocal(id int, msg []byte) bool {
+	conn := c.GetConn(id)
+	if conn == nil {
+		return false
+	}
+
+	conn.SendMsg(msg)
+	return true
+}
+
+func (c *KannaServer) record(dir int, connID int, data []byte) {
+	if c.Recorder != nil {
+		c.Recorder.Record(dir, connID, data)
+	}
+}
 
-		for _, conn := range c.connections {
-			log.Println("Send close", conn)
+func (c *KannaServer) maxMsgLen() int {
+	return c.live().maxMsgLen
+}
+
+func (c *KannaServer) CloseAllConn() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+	for c.ExistsConn() {
+		for _, conn := range c.GetConns() {
+			log.Println("Send close", conn.GetID())
 			conn.Stop()
 		}
 
@@ -59,9 +184,26 @@ func (c *KannaServer) CloseAllConn() {
 }
 
 func (c *KannaServer) ExistsConn() bool {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+
 	return len(c.connections) > 0
 }
 
+func (c *KannaServer) incSendCount() {
+	c.sendCountLock.Lock()
+	defer c.sendCountLock.Unlock()
+
+	c.SendCount++
+}
+
+func (c *KannaServer) GetSendCount() int {
+	c.sendCountLock.Lock()
+	defer c.sendCountLock.Unlock()
+
+	return c.SendCount
+}
+
 func (c *KannaServer) RemoveConn(conn IKannaConnBehavior) {
 	c.connLock.Lock()
 	defer c.connLock.Unlock()
@@ -70,8 +212,8 @@ func (c *KannaServer) RemoveConn(conn IKannaConnBehavior) {
 }
 
 func (c *KannaServer) Listen(addr string, port int, msgHandler MsgHandler) {
-	if addr[0:7] == "socket:" && port == -1 {
-		c.listenUnixSocket(addr[7:], msgHandler)
+	if strings.HasPrefix(addr, "socket:") && port == -1 {
+		c.listenUnixSocket(addr[len("socket:"):], msgHandler)
 	} else {
 		c.listenTCP(addr, port, msgHandler)
 	}
@@ -90,21 +232,11 @@ func (c *KannaServer) listenTCP(addr string, port int, msgHandler MsgHandler) {
 			panic(err)
 		}
 
-		for {
-			conn, err := listener.AcceptTCP()
-			if err != nil {
-				log.Println("tcp Accept err", err)
-				continue
-			}
-
-			GServId++
-			dealConn := NewKannaTcpConnection(c, GServId, conn, msgHandler)
-			if c.OnConnStart != nil {
-				c.OnConnStart(dealConn)
-			}
-
-			go dealConn.Start()
+		// 临时错误会重试, 其他错误时退出并减少listeners
+		if err := c.Serve(listener, msgHandler); err != nil {
+			log.Println("tcp Accept err", err)
 		}
+		listener.Close()
 	}()
 }
 
@@ -123,20 +255,81 @@ func (c *KannaServer) listenUnixSocket(path string, msgHandler MsgHandler) {
 			return
 		}
 
-		for {
-			conn, err := listener.AcceptUnix()
-			if err != nil {
-				log.Println("unix Accept err", err)
+		if err := c.Serve(listener, msgHandler); err != nil {
+			log.Println("unix Accept err", err)
+		}
+		listener.Close()
+	}()
+}
+
+// 在外部创建的listener上接受连接, listener关闭后返回
+func (c *KannaServer) Serve(listener net.Listener, msgHandler MsgHandler) error {
+	return c.serve(listener, msgHandler, false)
+}
+
+func (c *KannaServer) serve(listener net.Listener, msgHandler MsgHandler, eventLoop bool) error {
+	atomic.AddInt32(&c.listeners, 1)
+	defer atomic.AddInt32(&c.listeners, -1)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("Accept err", err)
 				continue
 			}
 
-			GServId++
-			dealConn := NewKannaUnixSocketConnection(c, GServId, conn, msgHandler)
-			if c.OnConnStart != nil {
-				c.OnConnStart(dealConn)
-			}
+			return err
+		}
+
+		c.serveConn(conn, msgHandler, eventLoop)
+	}
+}
+
+// 接管一个已经建立的连接, 比如net.Pipe, 被拒绝时返回nil
+func (c *KannaServer) ServeConn(conn net.Conn, msgHandler MsgHandler) IKannaConnBehavior {
+	return c.serveConn(conn, msgHandler, false)
+}
+
+func (c *KannaServer) serveConn(conn net.Conn, msgHandler MsgHandler, eventLoop bool) IKannaConnBehavior {
+	id := c.nextConnID()
+	if err := c.admit(id, remoteIP(conn)); err != nil {
+		log.Println("reject conn", conn.RemoteAddr(), err)
+		c.reject(conn, err)
+		return nil
+	}
 
-			go dealConn.Start()
+	var dealConn IKannaConnBehavior
+	if eventLoop {
+		if ec, err := NewKannaEventLoopConnection(c, id, conn, msgHandler); err == nil {
+			dealConn = ec
+		} else {
+			log.Println("event loop unavailable, fallback", id, err)
 		}
-	}()
+	}
+
+	if dealConn == nil {
+		switch v := conn.(type) {
+		case *net.TCPConn:
+			dealConn = NewKannaTcpConnection(c, id, v, msgHandler)
+		case *net.UnixConn:
+			dealConn = NewKannaUnixSocketConnection(c, id, v, msgHandler)
+		default:
+			dealConn = NewKannaNetConnection(c, id, conn, msgHandler)
+		}
+	}
+
+	if c.OnConnStart != nil {
+		if err := c.OnConnStart(dealConn); err != nil {
+			log.Println("reject conn", id, err)
+			if r, ok := dealConn.(interface{ markRejected(IKannaConnBehavior) }); ok {
+				r.markRejected(dealConn)
+			}
+			c.reject(conn, err)
+			return nil
+		}
+	}
+
+	go dealConn.Start()
+	return dealConn
 }
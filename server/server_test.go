@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "temporary" }
+func (tempErr) Timeout() bool   { return false }
+func (tempErr) Temporary() bool { return true }
+
+// 先返回几次临时错误, 之后返回普通错误
+type failingListener struct {
+	net.Listener
+	temp int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.temp > 0 {
+		l.temp--
+		return nil, tempErr{}
+	}
+
+	return nil, errors.New("accept failed")
+}
+
+func TestServeFatalAcceptErr(t *testing.T) {
+	s := NewKananServer()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(&failingListener{temp: 3}, nil)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "accept failed" {
+			t.Fatalf("Serve returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after fatal accept error")
+	}
+
+	if n := atomic.LoadInt32(&s.listeners); n != 0 || s.serving() {
+		t.Fatalf("listeners = %d after Serve returned", n)
+	}
+}
+
+// 100个net.Pipe连接, 对端只读不处理
+func BenchmarkBroadcast(b *testing.B) {
+	s := NewKananServer()
+	_, peers := pipeConns(b, s, 100, nil)
+
+	pack := NewDataPack("ticker")
+	pack.PushData("BTC-USDT", "43210.5", time.Now().UnixNano())
+	msg := pack.Pack()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Broadcast(msg)
+	}
+	b.StopTimer()
+
+	s.CloseAllConn()
+	for _, peer := range peers {
+		peer.Close()
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// 连接建立后服务端下发 session{token}
+const OpSession = "session"
+
+// 客户端重连后发送 resume{token}msgId, 服务端回复 resume{ok,token,replayed} 或 resume{fail,reason}
+const OpResume = "resume"
+
+const DefaultSessionGrace = time.Second * 30
+const DefaultSessionBufferSize = 1000
+
+type Session struct {
+	Token string
+	Props *sync.Map
+
+	server   *KannaServer
+	conn     IKannaConnBehavior
+	subs     map[string]bool
+	pending  [][]byte
+	detached bool
+	expired  bool
+	expire   *time.Timer
+	reliable *reliableQueue
+	lock     sync.Mutex
+}
+
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// 随机数不可用时退化为时间戳, 保证至少可用
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func (s *Session) GetConnection() IKannaConnBehavior {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.conn
+}
+
+func (s *Session) Subscriptions() (res []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for topic := range s.subs {
+		res = append(res, topic)
+	}
+
+	return res
+}
+
+func (s *Session) IsDetached() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.detached
+}
+
+func (s *Session) addSub(topic string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.subs[topic] = true
+}
+
+func (s *Session) removeSub(topic string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.subs, topic)
+}
+
+// 断线期间缓存消息, 超过上限丢弃最早的, 返回false表示session不在等待重连
+// conn正在stop还没有detach时也缓存, 否则这段时间发的消息会丢
+func (s *Session) buffer(conn IKannaConnBehavior, data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.expired || (!s.detached && s.conn != conn) {
+		return false
+	}
+
+	limit := s.server.sessionBufferSize()
+
+	if len(s.pending) >= limit {
+		s.pending = s.pending[1:]
+	}
+	s.pending = append(s.pending, data)
+
+	return true
+}
+
+func (c *KannaServer) newSession(conn *sKannaConnection, wrapper IKannaConnBehavior) *Session {
+	sess := &Session{
+		Token:    newSessionToken(),
+		Props:    conn.GetProps(),
+		server:   c,
+		conn:     wrapper,
+		subs:     make(map[string]bool),
+		reliable: conn.reliable,
+	}
+
+	c.sessionLock.Lock()
+	c.sessions[sess.Token] = sess
+	c.sessionLock.Unlock()
+
+	conn.setSession(sess)
+	return sess
+}
+
+func (c *KannaServer) GetSession(token string) *Session {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+
+	return c.sessions[token]
+}
+
+// 连接断开后保留session等待重连, 超时后彻底释放
+func (c *KannaServer) detachSession(sess *Session) {
+	grace := c.sessionGrace()
+
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	if sess.expired {
+		return
+	}
+
+	sess.detached = true
+	sess.expire = time.AfterFunc(grace, func() {
+		c.expireSession(sess)
+	})
+}
+
+func (c *KannaServer) expireSession(sess *Session) {
+	sess.lock.Lock()
+	if !sess.detached || sess.expired {
+		sess.lock.Unlock()
+		return
+	}
+
+	sess.expired = true
+	sess.pending = nil
+	conn := sess.conn
+	sess.lock.Unlock()
+
+	c.sessionLock.Lock()
+	delete(c.sessions, sess.Token)
+	c.sessionLock.Unlock()
+
+	c.removeAllSubs(conn)
+	c.failDelivery(conn, sess.reliable)
+	log.Println("session expired", sess.Token)
+}
+
+func (c *KannaServer) dropSession(sess *Session) {
+	sess.lock.Lock()
+	sess.expired = true
+	if sess.expire != nil {
+		sess.expire.Stop()
+	}
+	sess.lock.Unlock()
+
+	c.sessionLock.Lock()
+	delete(c.sessions, sess.Token)
+	c.sessionLock.Unlock()
+}
+
+// 把旧session接到新连接上, 恢复props和订阅, 返回需要补发的消息
+func (c *KannaServer) resumeSession(token string, conn *sKannaConnection, wrapper IKannaConnBehavior) (*Session, [][]byte, error) {
+	sess := c.GetSession(token)
+	if sess == nil {
+		return nil, nil, fmt.Errorf("session not found")
+	}
+
+	current := conn.GetSession()
+	if sess == current {
+		return nil, nil, fmt.Errorf("session already attached")
+	}
+
+	// 服务端可能还没发现旧连接已经断开, 或者旧连接正在stop
+	// Stop会等正在执行的stop结束, 之后session已经detach
+	if old := sess.GetConnection(); old != nil {
+		old.Stop()
+	}
+
+	sess.lock.Lock()
+	if sess.expired || !sess.detached {
+		sess.lock.Unlock()
+		return nil, nil, fmt.Errorf("session expired")
+	}
+
+	if sess.expire != nil {
+		sess.expire.Stop()
+	}
+
+	old := sess.conn
+	pending := sess.pending
+	sess.pending = nil
+	sess.detached = false
+	sess.conn = wrapper
+	var topics []string
+	for topic := range sess.subs {
+		topics = append(topics, topic)
+	}
+	sess.lock.Unlock()
+
+	if current != nil {
+		c.dropSession(current)
+	}
+	conn.setSession(sess)
+
+	c.removeAllSubs(old)
+	for _, topic := range topics {
+		c.Subscribe(wrapper, topic)
+	}
+
+	return sess, pending, nil
+}
+
+func (c *sKannaConnection) handleResume(conn IKannaConnBehavior, cmd *OpCmd) {
+	reply := NewDataPack(OpResume)
+	reply.SetMsgId(cmd.MsgId)
+
+	token := ""
+	if len(cmd.Args) > 0 {
+		token = cmd.Args[0]
+	}
+
+	sess, pending, err := c.Server.resumeSession(token, c, conn)
+	if err != nil {
+		reply.PushData("fail", err.Error())
+		conn.SendMsg(reply.Pack())
+		return
+	}
+
+	reply.PushData("ok", sess.Token, len(pending))
+	conn.SendMsg(reply.Pack())
+
+	for _, data := range pending {
+		conn.SendMsg(data)
+	}
+
+	c.retransmit(conn)
+}
+
+// 连接启动时创建session并下发token
+func (c *sKannaConnection) startSession(conn IKannaConnBehavior) {
+	if !c.Server.EnableSession {
+		return
+	}
+
+	sess := c.Server.newSession(c, conn)
+	pack := NewDataPack(OpSession)
+	pack.PushData(sess.Token)
+	conn.SendMsg(pack.Pack())
+}
+
+// 连接停止时调用, 有session的等待重连, 没有的直接清理
+func (c *sKannaConnection) release(conn IKannaConnBehavior) {
+	sess := c.GetSession()
+	if sess == nil {
+		c.Server.removeAllSubs(conn)
+		c.Server.failDelivery(conn, c.reliable)
+		return
+	}
+
+	if sess.GetConnection() == conn {
+		c.Server.detachSession(sess)
+		return
+	}
+
+	// session已经转移到新连接上
+	c.Server.removeAllSubs(conn)
+}
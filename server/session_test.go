@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 连接刚建立就发resume, 恢复的session不能被启动时新建的session覆盖
+func TestResumeRightAfterConnect(t *testing.T) {
+	s := NewKananServer()
+	s.EnableSession = true
+
+	_, first := pipeClient(t, s, nil)
+	frame, err := first.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := frame.Values()[0]
+	sess := s.GetSession(token)
+	first.Close()
+
+	deadline := time.Now().Add(time.Second * 2)
+	for !sess.IsDetached() {
+		if time.Now().After(deadline) {
+			t.Fatal("session not detached after peer close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 20; i++ {
+		c1, c2 := net.Pipe()
+		go c1.Write(EncodeCmd(OpResume, "1", token))
+
+		conn := s.ServeConn(c2, nil)
+		client := NewKannaClient(c1)
+		client.Conn.SetDeadline(time.Now().Add(time.Second * 2))
+
+		if vals := readOp(t, client, OpResume).Values(); vals[0] != "ok" {
+			t.Fatalf("resume reply %q", vals)
+		}
+
+		if got := conn.(*KannaNetConnection).GetSession(); got != sess {
+			t.Fatalf("round %d: conn has session %s, want %s", i, got.Token, token)
+		}
+
+		client.Close()
+		for !sess.IsDetached() {
+			if time.Now().After(deadline) {
+				t.Fatal("session not detached after peer close")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// 旧连接的OnConnEnd阻塞住, 这时stop已经开始但session还没有detach
+func closingSession(t *testing.T, s *KannaServer, onClosing func(conn IKannaConnBehavior)) (token string, release func()) {
+	s.EnableSession = true
+
+	conn, client := pipeClient(t, s, nil)
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closing := make(chan struct{})
+	unblock := make(chan struct{})
+	s.OnConnEnd = func(c IKannaConnBehavior) {
+		if c != conn {
+			return
+		}
+
+		if onClosing != nil {
+			onClosing(c)
+		}
+		close(closing)
+		<-unblock
+	}
+
+	client.Close()
+	select {
+	case <-closing:
+	case <-time.After(time.Second):
+		t.Fatal("OnConnEnd not called after peer close")
+	}
+
+	var once sync.Once
+	release = func() { once.Do(func() { close(unblock) }) }
+	t.Cleanup(release)
+
+	return frame.Values()[0], release
+}
+
+// 旧连接正在stop时resume, 要等它detach后接管, 不能返回session expired
+func TestResumeWhileOldConnClosing(t *testing.T) {
+	s := NewKananServer()
+	token, release := closingSession(t, s, nil)
+
+	_, client := pipeClient(t, s, nil)
+	readOp(t, client, OpSession)
+	if _, err := client.Send(OpResume, token); err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(time.Millisecond*50, release)
+	if vals := readOp(t, client, OpResume).Values(); vals[0] != "ok" {
+		t.Fatalf("resume reply %q", vals)
+	}
+}
+
+// 连接已经关闭但session还没有detach时发的消息, resume后补发
+func TestSendWhileConnClosing(t *testing.T) {
+	s := NewKananServer()
+	sent := make(chan error, 1)
+	token, release := closingSession(t, s, func(conn IKannaConnBehavior) {
+		sent <- conn.SendMsg(EncodeCmd("missed", "", "1"))
+	})
+
+	if err := <-sent; err != nil {
+		t.Fatalf("SendMsg while closing: %v", err)
+	}
+	release()
+
+	_, client := pipeClient(t, s, nil)
+	readOp(t, client, OpSession)
+	if _, err := client.Send(OpResume, token); err != nil {
+		t.Fatal(err)
+	}
+
+	if vals := readOp(t, client, OpResume).Values(); vals[0] != "ok" || vals[2] != "1" {
+		t.Fatalf("resume reply %q, want ok with 1 replayed", vals)
+	}
+	expectOp(t, client, "missed")
+}
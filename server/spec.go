@@ -0,0 +1,323 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// 参数类型
+const ArgString = "string"
+const ArgInt = "int"
+const ArgDecimal = "decimal"
+const ArgBool = "bool"
+const ArgTime = "time" // 毫秒时间戳或RFC3339
+
+// 校验失败时回复 error{code,field,message}msgId
+const OpError = "error"
+
+const ErrCodeUnknownOp = "unknown_op"
+const ErrCodeMissingArg = "missing_arg"
+const ErrCodeTooManyArgs = "too_many_args"
+const ErrCodeBadType = "bad_type"
+const ErrCodeBadValue = "bad_value"
+
+type ArgSpec struct {
+	Name     string
+	Type     string
+	Required bool
+	Choices  []string // 不为空时只允许这些值
+	Desc     string
+}
+
+type OpSpec struct {
+	Op         string
+	Desc       string
+	Args       []ArgSpec
+	Reply      []ArgSpec // 回复的列
+	ReplyMulti bool      // 回复是否为多行
+}
+
+type OpHandler func(r *Request, cmd *OpCmd)
+
+type SpecError struct {
+	Code    string
+	Field   string
+	Message string
+}
+
+func (e *SpecError) Error() string {
+	if e.Field == "" {
+		return e.Code + ": " + e.Message
+	}
+
+	return fmt.Sprintf("%s: %s %s", e.Code, e.Field, e.Message)
+}
+
+// 生成错误回复
+func (e *SpecError) Pack(msgId string) []byte {
+	pack := NewDataPack(OpError)
+	pack.SetMsgId(msgId)
+	pack.PushData(e.Code, e.Field, e.Message)
+
+	return pack.Pack()
+}
+
+type opRoute struct {
+	spec    OpSpec
+	handler OpHandler
+}
+
+// 按op分发到注册的handler, 分发前按OpSpec校验参数, 本身是一个MsgHandler
+type OpRouter struct {
+	NotFound MsgHandler // 没有注册的op, 为nil时回复unknown_op
+
+	routes map[string]*opRoute
+	lock   sync.RWMutex
+}
+
+func NewOpRouter() *OpRouter {
+	return &OpRouter{
+		routes: make(map[string]*opRoute),
+	}
+}
+
+// 参数类型不认识时panic, 否则这个参数永远校验不过
+func (rt *OpRouter) Register(spec OpSpec, handler OpHandler) {
+	for _, args := range [][]ArgSpec{spec.Args, spec.Reply} {
+		for _, arg := range args {
+			if !isArgType(arg.Type) {
+				panic(fmt.Sprintf("op %s: unknown type %q of %s", spec.Op, arg.Type, arg.Name))
+			}
+		}
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	rt.routes[spec.Op] = &opRoute{spec: spec, handler: handler}
+}
+
+func (rt *OpRouter) GetSpec(op string) (OpSpec, bool) {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	route, ok := rt.routes[op]
+	if !ok {
+		return OpSpec{}, false
+	}
+
+	return route.spec, true
+}
+
+// 按op排序
+func (rt *OpRouter) Specs() (res []OpSpec) {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	for _, route := range rt.routes {
+		res = append(res, route.spec)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Op < res[j].Op })
+
+	return res
+}
+
+func (rt *OpRouter) Handle(r *Request) {
+	cmd := ParseOp(r.GetData())
+	if cmd == nil {
+		return
+	}
+
+	rt.lock.RLock()
+	route, ok := rt.routes[cmd.Op]
+	rt.lock.RUnlock()
+
+	if !ok {
+		if rt.NotFound != nil {
+			rt.NotFound(r)
+			return
+		}
+
+		err := &SpecError{Code: ErrCodeUnknownOp, Field: cmd.Op, Message: "unknown op"}
+		r.GetConnection().SendMsg(err.Pack(cmd.MsgId))
+		return
+	}
+
+	if err := route.spec.Validate(cmd); err != nil {
+		r.GetConnection().SendMsg(err.Pack(cmd.MsgId))
+		return
+	}
+
+	route.handler(r, cmd)
+}
+
+// op{}解析出来是一个空字符串参数, 当作没有参数
+func cmdArgs(cmd *OpCmd) []string {
+	if len(cmd.Args) == 1 && cmd.Args[0] == "" {
+		return nil
+	}
+
+	return cmd.Args
+}
+
+func (s *OpSpec) Validate(cmd *OpCmd) *SpecError {
+	args := cmdArgs(cmd)
+	if len(args) > len(s.Args) {
+		return &SpecError{
+			Code:    ErrCodeTooManyArgs,
+			Message: fmt.Sprintf("want at most %d args, got %d", len(s.Args), len(args)),
+		}
+	}
+
+	for k, arg := range s.Args {
+		value := ""
+		if k < len(args) {
+			value = strings.TrimSpace(args[k])
+		}
+
+		if value == "" {
+			if arg.Required {
+				return &SpecError{Code: ErrCodeMissingArg, Field: arg.Name, Message: "is required"}
+			}
+
+			continue
+		}
+
+		if err := arg.Validate(value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *ArgSpec) Validate(value string) *SpecError {
+	if !checkArgType(a.Type, value) {
+		return &SpecError{Code: ErrCodeBadType, Field: a.Name, Message: "want " + a.Type}
+	}
+
+	if len(a.Choices) == 0 {
+		return nil
+	}
+
+	for _, choice := range a.Choices {
+		if value == choice {
+			return nil
+		}
+	}
+
+	return &SpecError{Code: ErrCodeBadValue, Field: a.Name, Message: "want one of " + strings.Join(a.Choices, "|")}
+}
+
+// 空的当作ArgString
+func isArgType(typ string) bool {
+	switch typ {
+	case "", ArgString, ArgInt, ArgDecimal, ArgBool, ArgTime:
+		return true
+	}
+
+	return false
+}
+
+func checkArgType(typ string, value string) bool {
+	switch typ {
+	case "", ArgString:
+		return true
+	case ArgInt:
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	case ArgDecimal:
+		// ParseFloat会接受0x1p-2, 1_000, Inf和NaN
+		_, err := decimal.NewFromString(value)
+		return err == nil
+	case ArgBool:
+		_, err := strconv.ParseBool(value)
+		return err == nil
+	case ArgTime:
+		_, err := ParseArgTime(value)
+		return err == nil
+	}
+
+	return false
+}
+
+// 毫秒时间戳或RFC3339
+func ParseArgTime(value string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// 生成markdown格式的协议文档
+func (rt *OpRouter) Markdown() string {
+	var sb strings.Builder
+	sb.WriteString("# Kanna protocol reference\n\n")
+	sb.WriteString("请求格式为 `op{arg,arg}msgId`, 回复格式为 `op{col\\tcol}msgId`, 多行回复用换行分隔.\n")
+	sb.WriteString("参数校验失败时回复 `error{code\\tfield\\tmessage}msgId`.\n")
+
+	for _, spec := range rt.Specs() {
+		sb.WriteString("\n## " + spec.Op + "\n\n")
+		if spec.Desc != "" {
+			sb.WriteString(spec.Desc + "\n\n")
+		}
+
+		var names []string
+		for _, arg := range spec.Args {
+			names = append(names, arg.Name)
+		}
+		sb.WriteString("`" + spec.Op + "{" + strings.Join(names, ",") + "}msgId`\n\n")
+
+		if len(spec.Args) > 0 {
+			writeArgTable(&sb, spec.Args, true)
+		}
+
+		if len(spec.Reply) > 0 {
+			if spec.ReplyMulti {
+				sb.WriteString("\n回复 (多行):\n\n")
+			} else {
+				sb.WriteString("\n回复:\n\n")
+			}
+			writeArgTable(&sb, spec.Reply, false)
+		}
+	}
+
+	return sb.String()
+}
+
+func writeArgTable(sb *strings.Builder, args []ArgSpec, withRequired bool) {
+	if withRequired {
+		sb.WriteString("| # | name | type | required | description |\n|---|---|---|---|---|\n")
+	} else {
+		sb.WriteString("| # | name | type | description |\n|---|---|---|---|\n")
+	}
+
+	for k, arg := range args {
+		typ := arg.Type
+		if typ == "" {
+			typ = ArgString
+		}
+
+		desc := arg.Desc
+		if len(arg.Choices) > 0 {
+			desc = strings.TrimSpace(desc + " (" + strings.Join(arg.Choices, " / ") + ")")
+		}
+
+		if withRequired {
+			required := "no"
+			if arg.Required {
+				required = "yes"
+			}
+			fmt.Fprintf(sb, "| %d | %s | %s | %s | %s |\n", k+1, arg.Name, typ, required, desc)
+		} else {
+			fmt.Fprintf(sb, "| %d | %s | %s | %s |\n", k+1, arg.Name, typ, desc)
+		}
+	}
+}
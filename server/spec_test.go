@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestCheckArgType(t *testing.T) {
+	cases := []struct {
+		typ   string
+		value string
+		ok    bool
+	}{
+		{ArgString, "anything", true},
+		{"", "anything", true},
+		{ArgInt, "-42", true},
+		{ArgInt, "1.5", false},
+		{ArgInt, "99999999999999999999", false},
+		{ArgDecimal, "1.25", true},
+		{ArgDecimal, "-0.00000001", true},
+		{ArgDecimal, "100", true},
+		{ArgDecimal, "1e3", true},
+		{ArgDecimal, "0x1p-2", false},
+		{ArgDecimal, "1_000", false},
+		{ArgDecimal, "Inf", false},
+		{ArgDecimal, "-Inf", false},
+		{ArgDecimal, "NaN", false},
+		{ArgDecimal, "1.2.3", false},
+		{ArgBool, "true", true},
+		{ArgBool, "yes", false},
+		{ArgTime, "1700000000000", true},
+		{ArgTime, "2023-11-14T22:13:20Z", true},
+		{ArgTime, "2023-11-14", false},
+		{"float", "1", false},
+	}
+
+	for _, c := range cases {
+		if ok := checkArgType(c.typ, c.value); ok != c.ok {
+			t.Errorf("%s %q: got %v, want %v", c.typ, c.value, ok, c.ok)
+		}
+	}
+}
+
+func TestOpSpecValidate(t *testing.T) {
+	spec := OpSpec{
+		Op: "order",
+		Args: []ArgSpec{
+			{Name: "symbol", Required: true},
+			{Name: "side", Required: true, Choices: []string{"buy", "sell"}},
+			{Name: "price", Type: ArgDecimal},
+		},
+	}
+
+	cases := []struct {
+		line string
+		code string
+	}{
+		{"order{BTC,buy,1.5}1", ""},
+		{"order{BTC,sell}1", ""},
+		{"order{BTC, buy ,}1", ""},
+		{"order{}1", ErrCodeMissingArg},
+		{"order{BTC,hold}1", ErrCodeBadValue},
+		{"order{BTC,buy,Inf}1", ErrCodeBadType},
+		{"order{BTC,buy,1,2}1", ErrCodeTooManyArgs},
+	}
+
+	for _, c := range cases {
+		code := ""
+		if err := spec.Validate(ParseOp([]byte(c.line))); err != nil {
+			code = err.Code
+		}
+
+		if code != c.code {
+			t.Errorf("%s: got %q, want %q", c.line, code, c.code)
+		}
+	}
+}
+
+func TestRegisterUnknownType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Register accepted unknown arg type")
+		}
+	}()
+
+	NewOpRouter().Register(OpSpec{Op: "order", Args: []ArgSpec{{Name: "price", Type: "float"}}}, nil)
+}
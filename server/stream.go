@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// 包头长度的第三高位表示分块帧, 帧体前5字节为 标记 + 块序号(uint32), 后面是正常的op{rows}msgId
+// 同一个回复的所有块op和msgId相同, 只有一块或者hello握手时没有协商chunk时直接发普通帧
+const FrameFlagChunk uint32 = 1 << 29
+
+const ChunkBegin byte = 1
+const ChunkContinue byte = 2
+const ChunkEnd byte = 3
+
+const chunkPrefixLen = 5
+
+const DefaultStreamChunkSize = 32 * 1024
+
+// 发送队列占用超过这个比例时分块回复先等待, 给其他消息留出位置
+const streamQueueRatio = 2
+
+// 等待发送队列的最长时间, 超过后这次分块回复失败
+const streamQueueTimeout = time.Second * 10
+
+// 按块大小把多行数据拆分发送, 用法:
+//
+//	w := NewStreamWriter(conn, "orders", cmd.MsgId)
+//	for _, o := range orders {
+//		w.Push(o.ID, o.Price)
+//	}
+//	w.Close()
+type StreamWriter struct {
+	ChunkSize int
+
+	conn    IKannaConnBehavior
+	op      string
+	msgId   string
+	pack    *DataPack
+	size    int
+	index   uint32
+	scratch bytes.Buffer
+}
+
+func NewStreamWriter(conn IKannaConnBehavior, op string, msgId string) *StreamWriter {
+	w := &StreamWriter{
+		ChunkSize: DefaultStreamChunkSize,
+		conn:      conn,
+		op:        op,
+		msgId:     msgId,
+	}
+	w.reset()
+
+	return w
+}
+
+func (w *StreamWriter) reset() {
+	w.pack = NewDataPack(w.op)
+	w.pack.SetMsgId(w.msgId)
+	w.pack.Multi()
+	w.size = 0
+}
+
+// 追加一行, 攒够ChunkSize后发出一块
+func (w *StreamWriter) Push(vals ...interface{}) error {
+	w.scratch.Reset()
+	for _, v := range vals {
+		writeValue(&w.scratch, v)
+		w.scratch.WriteByte('\t')
+	}
+
+	w.pack.PushData(vals...)
+	w.size += w.scratch.Len()
+	if w.size < w.ChunkSize || !connSupports(w.conn, FeatureChunk) {
+		return nil
+	}
+
+	marker := ChunkContinue
+	if w.index == 0 {
+		marker = ChunkBegin
+	}
+
+	return w.flush(marker)
+}
+
+func (w *StreamWriter) PushStruct(v interface{}) error {
+	return w.Push(structValues(v)...)
+}
+
+// 发出最后一块, 没有拆分过的话发普通帧
+func (w *StreamWriter) Close() error {
+	if w.index == 0 {
+		data := w.pack.Pack()
+		w.reset()
+		return w.conn.SendMsg(data)
+	}
+
+	return w.flush(ChunkEnd)
+}
+
+func (w *StreamWriter) flush(marker byte) error {
+	data := chunkFrame(marker, w.index, w.pack.Pack())
+	w.index++
+	w.reset()
+
+	if err := waitWriteQueue(w.conn); err != nil {
+		return err
+	}
+
+	return w.conn.SendMsg(data)
+}
+
+// 把多行的DataPack拆成块发送, chunkSize<=0时使用DefaultStreamChunkSize
+func SendStream(conn IKannaConnBehavior, pack *DataPack, chunkSize int) error {
+	w := NewStreamWriter(conn, pack.Op, pack.sMsgId)
+	if chunkSize > 0 {
+		w.ChunkSize = chunkSize
+	}
+
+	if !pack.bMulti {
+		w.Push(pack.Data...)
+		return w.Close()
+	}
+
+	for _, row := range pack.Data {
+		if err := w.Push(row.([]interface{})...); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+func chunkFrame(marker byte, index uint32, data []byte) []byte {
+	body := data[PackHeadLen:]
+	res := make([]byte, PackHeadLen+chunkPrefixLen+len(body))
+	binary.BigEndian.PutUint32(res, uint32(chunkPrefixLen+len(body))|FrameFlagChunk)
+	res[PackHeadLen] = marker
+	binary.BigEndian.PutUint32(res[PackHeadLen+1:], index)
+	copy(res[PackHeadLen+chunkPrefixLen:], body)
+
+	return res
+}
+
+type writeQueued interface {
+	waitQueue(timeout time.Duration) error
+}
+
+// 发送队列过半时等writer写完一批再检查, 对端一直不读时超时返回错误
+func (c *sKannaConnection) waitQueue(timeout time.Duration) error {
+	var timer *time.Timer
+	for len(c.msgChan)*streamQueueRatio >= cap(c.msgChan) {
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+
+		select {
+		case <-c.drained:
+		case <-c.ExitBuffChan:
+			return fmt.Errorf("connection closed")
+		case <-timer.C:
+			return fmt.Errorf("write queue still full after %v", timeout)
+		}
+	}
+
+	return nil
+}
+
+// writer每写完一批调用一次, 没有人等待时丢弃
+func (c *sKannaConnection) notifyDrained() {
+	select {
+	case c.drained <- struct{}{}:
+	default:
+	}
+}
+
+// 发送队列过半时等待writer消化, 避免一个大回复占满队列饿死其他消息
+func waitWriteQueue(conn IKannaConnBehavior) error {
+	q, ok := conn.(writeQueued)
+	if !ok {
+		return nil
+	}
+
+	if err := q.waitQueue(streamQueueTimeout); err != nil {
+		return err
+	}
+
+	runtime.Gosched()
+	return nil
+}
+
+// 客户端把分块帧拼回完整的帧, 非分块帧原样返回
+type ChunkAssembler struct {
+	pending map[string]*chunkState
+}
+
+type chunkState struct {
+	first  *Frame
+	next   uint32
+	bodies []string
+	raw    []byte
+}
+
+func NewChunkAssembler() *ChunkAssembler {
+	return &ChunkAssembler{
+		pending: make(map[string]*chunkState),
+	}
+}
+
+// 收齐之前返回nil, 拼好的帧Raw为所有分块原始数据的拼接
+func (a *ChunkAssembler) Add(f *Frame) (*Frame, error) {
+	if f.Flags&FrameFlagChunk == 0 {
+		return f, nil
+	}
+
+	key := f.Op + "{}" + f.MsgId
+	if f.Chunk == ChunkBegin {
+		a.pending[key] = &chunkState{first: f}
+	}
+
+	state, ok := a.pending[key]
+	if !ok {
+		return nil, fmt.Errorf("chunk %d of %s without begin", f.ChunkIndex, key)
+	}
+
+	if f.ChunkIndex != state.next {
+		delete(a.pending, key)
+		return nil, fmt.Errorf("chunk of %s out of order, want %d got %d", key, state.next, f.ChunkIndex)
+	}
+
+	state.next++
+	state.raw = append(state.raw, f.Raw...)
+	if body := strings.Join(f.Args, ","); body != "" {
+		state.bodies = append(state.bodies, body)
+	}
+
+	if f.Chunk != ChunkEnd {
+		return nil, nil
+	}
+
+	delete(a.pending, key)
+
+	cmd := &OpCmd{Op: f.Op, MsgId: f.MsgId, Args: strings.Split(strings.Join(state.bodies, "\n"), ",")}
+	return &Frame{
+		OpCmd: cmd,
+		Rows:  splitRows(cmd),
+		Seq:   state.first.Seq,
+		Flags: state.first.Flags &^ FrameFlagChunk,
+		Raw:   state.raw,
+	}, nil
+}
+
+// 放弃还没收齐的回复
+func (a *ChunkAssembler) Drop(op string, msgId string) {
+	delete(a.pending, op+"{}"+msgId)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 拆成多块发送, 客户端用ChunkAssembler拼回来和原来的行相同
+// 发送队列很小, 分块回复要等writer消化
+func TestStreamChunkedRoundTrip(t *testing.T) {
+	s := NewKananServer()
+	s.EnableHello = true
+	s.WriteQueueSize = 4
+
+	const rows = 200
+	_, client := pipeClient(t, s, func(r *Request) {
+		w := NewStreamWriter(r.GetConnection(), "rows", ParseOp(r.GetData()).MsgId)
+		w.ChunkSize = 64
+		for i := 0; i < rows; i++ {
+			if err := w.Push(i, "BTC-USDT"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if _, err := client.Hello(ProtocolVersion, nil, []string{FeatureChunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgId, err := client.Send("rows")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewChunkAssembler()
+	chunks := 0
+	var frame *Frame
+	for frame == nil {
+		f, err := client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Flags&FrameFlagChunk == 0 {
+			t.Fatalf("got plain frame %s, want chunks", f.Op)
+		}
+		chunks++
+
+		if frame, err = a.Add(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if chunks < 2 || frame.Op != "rows" || frame.MsgId != msgId {
+		t.Fatalf("got %s msgId %s from %d chunks", frame.Op, frame.MsgId, chunks)
+	}
+
+	if len(frame.Rows) != rows {
+		t.Fatalf("got %d rows, want %d", len(frame.Rows), rows)
+	}
+
+	for k, row := range frame.Rows {
+		if row[0] != strconv.Itoa(k) || row[1] != "BTC-USDT" {
+			t.Fatalf("row %d is %q", k, row)
+		}
+	}
+}
+
+// 让writer阻塞在写socket上, 队列里留一条
+func fillWriteQueue(t *testing.T, conn IKannaConnBehavior) *KannaNetConnection {
+	c := conn.(*KannaNetConnection)
+	conn.SendMsg(EncodeCmd("a", ""))
+
+	deadline := time.Now().Add(time.Second)
+	for len(c.msgChan) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writer did not take the first message")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.SendMsg(EncodeCmd("b", ""))
+	return c
+}
+
+// 对端不读时发送队列一直是满的, 等待超时返回错误, 对端读了之后writer会通知
+func TestWaitQueue(t *testing.T) {
+	s := NewKananServer()
+	s.WriteQueueSize = 2
+
+	conn, client := pipeClient(t, s, nil)
+	c := fillWriteQueue(t, conn)
+	if err := c.waitQueue(time.Millisecond * 50); err == nil {
+		t.Fatal("waitQueue returned nil with a full queue")
+	}
+
+	go func() {
+		client.ReadFrame()
+		client.ReadFrame()
+	}()
+	if err := c.waitQueue(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 连接关闭时不等到超时
+func TestWaitQueueClosed(t *testing.T) {
+	s := NewKananServer()
+	s.WriteQueueSize = 2
+
+	conn, _ := pipeClient(t, s, nil)
+	c := fillWriteQueue(t, conn)
+	conn.Stop()
+
+	start := time.Now()
+	if err := c.waitQueue(time.Second * 5); err == nil {
+		t.Fatal("waitQueue returned nil after Stop")
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("waitQueue took %v after Stop", d)
+	}
+}
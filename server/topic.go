@@ -0,0 +1,80 @@
+package server
+
+func (c *KannaServer) Subscribe(conn IKannaConnBehavior, topic string) {
+	c.topicLock.Lock()
+	subs, ok := c.topics[topic]
+	if !ok {
+		subs = make(map[int]IKannaConnBehavior)
+		c.topics[topic] = subs
+	}
+	subs[conn.GetID()] = conn
+	c.topicLock.Unlock()
+
+	if sess := conn.GetSession(); sess != nil {
+		sess.addSub(topic)
+	}
+}
+
+func (c *KannaServer) Unsubscribe(conn IKannaConnBehavior, topic string) {
+	c.removeSub(conn, topic)
+
+	if sess := conn.GetSession(); sess != nil {
+		sess.removeSub(topic)
+	}
+}
+
+func (c *KannaServer) Publish(topic string, msg []byte) {
+	c.publishLocal(topic, msg)
+
+	if c.cluster != nil {
+		c.cluster.forwardPublish(topic, msg)
+	}
+}
+
+func (c *KannaServer) publishLocal(topic string, msg []byte) {
+	c.topicLock.RLock()
+	var conns []IKannaConnBehavior
+	for _, conn := range c.topics[topic] {
+		conns = append(conns, conn)
+	}
+	c.topicLock.RUnlock()
+
+	for _, conn := range conns {
+		conn.SendMsg(msg)
+	}
+}
+
+func (c *KannaServer) GetSubscribers(topic string) int {
+	c.topicLock.RLock()
+	defer c.topicLock.RUnlock()
+
+	return len(c.topics[topic])
+}
+
+func (c *KannaServer) removeSub(conn IKannaConnBehavior, topic string) {
+	c.topicLock.Lock()
+	defer c.topicLock.Unlock()
+
+	subs, ok := c.topics[topic]
+	if !ok {
+		return
+	}
+
+	delete(subs, conn.GetID())
+	if len(subs) == 0 {
+		delete(c.topics, topic)
+	}
+}
+
+// 连接彻底释放时从所有topic中移除
+func (c *KannaServer) removeAllSubs(conn IKannaConnBehavior) {
+	c.topicLock.Lock()
+	defer c.topicLock.Unlock()
+
+	for topic, subs := range c.topics {
+		delete(subs, conn.GetID())
+		if len(subs) == 0 {
+			delete(c.topics, topic)
+		}
+	}
+}
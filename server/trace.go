@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 每个收到的帧一个span, 记录读取, 等待调度, handler执行, 回复写入socket的时间点
+// 回复指handler执行期间这个连接SendMsg的所有帧, 包括其他协程同时发给这个连接的, handler返回后异步发送的不算
+type Span struct {
+	ConnID      int
+	Op          string
+	MsgId       string
+	ReadStart   time.Time // 收到包头
+	ReadEnd     time.Time // 读完帧体
+	HandleStart time.Time // handler开始执行
+	HandleEnd   time.Time
+	WriteEnd    time.Time // 回复全部写入socket, 没有回复或者连接已断开时为零值
+	Replies     int
+
+	sendSeq uint64 // handler开始时连接的发送序号, 结束后改为需要等待写完的序号
+}
+
+func (s *Span) ReadDuration() time.Duration {
+	return s.ReadEnd.Sub(s.ReadStart)
+}
+
+func (s *Span) WaitDuration() time.Duration {
+	return s.HandleStart.Sub(s.ReadEnd)
+}
+
+func (s *Span) HandleDuration() time.Duration {
+	return s.HandleEnd.Sub(s.HandleStart)
+}
+
+func (s *Span) WriteDuration() time.Duration {
+	if s.WriteEnd.IsZero() {
+		return 0
+	}
+
+	return s.WriteEnd.Sub(s.HandleEnd)
+}
+
+// 在writer或者handler协程里同步调用, 需要并发安全, 耗时的导出自己放到队列里
+// 接OpenTelemetry用oteltrace子目录里的Exporter, 它是单独的module, 不会给server引入依赖
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+type SpanExporterFunc func(s *Span)
+
+func (f SpanExporterFunc) ExportSpan(s *Span) {
+	f(s)
+}
+
+type jsonSpan struct {
+	ConnID  int    `json:"conn"`
+	Op      string `json:"op"`
+	MsgId   string `json:"msg_id"`
+	Start   int64  `json:"start"` // 毫秒时间戳
+	Read    int64  `json:"read_us"`
+	Wait    int64  `json:"wait_us"`
+	Handle  int64  `json:"handler_us"`
+	Write   int64  `json:"write_us"`
+	Replies int    `json:"replies"`
+}
+
+type jsonExporter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// 每个span输出一行json, 时间单位为微秒
+func NewJSONExporter(w io.Writer) SpanExporter {
+	return &jsonExporter{w: w}
+}
+
+func (e *jsonExporter) ExportSpan(s *Span) {
+	b, err := json.Marshal(&jsonSpan{
+		ConnID:  s.ConnID,
+		Op:      s.Op,
+		MsgId:   s.MsgId,
+		Start:   s.ReadStart.UnixNano() / int64(time.Millisecond),
+		Read:    int64(s.ReadDuration() / time.Microsecond),
+		Wait:    int64(s.WaitDuration() / time.Microsecond),
+		Handle:  int64(s.HandleDuration() / time.Microsecond),
+		Write:   int64(s.WriteDuration() / time.Microsecond),
+		Replies: s.Replies,
+	})
+	if err != nil {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.w.Write(append(b, '\n'))
+}
+
+func (c *sKannaConnection) newSpan(readStart time.Time, data []byte) *Span {
+	if c.Server.SpanExporter == nil {
+		return nil
+	}
+
+	span := &Span{ConnID: c.ID, ReadStart: readStart, ReadEnd: time.Now()}
+	if cmd := ParseOp(data); cmd != nil {
+		span.Op, span.MsgId = cmd.Op, cmd.MsgId
+	}
+
+	return span
+}
+
+func (c *sKannaConnection) beginSpan(span *Span) {
+	if span == nil {
+		return
+	}
+
+	span.HandleStart = time.Now()
+	span.sendSeq = atomic.LoadUint64(&c.sendSeq)
+}
+
+// handler返回后调用, 有回复的等writer写完再导出
+func (c *sKannaConnection) endSpan(span *Span) {
+	if span == nil {
+		return
+	}
+
+	span.HandleEnd = time.Now()
+	seq := atomic.LoadUint64(&c.sendSeq)
+	span.Replies = int(seq - span.sendSeq)
+	if span.Replies == 0 {
+		c.Server.SpanExporter.ExportSpan(span)
+		return
+	}
+
+	span.sendSeq = seq
+	c.traceLock.Lock()
+	if c.writtenSeq >= seq || c.IsClosed() {
+		if c.writtenSeq >= seq {
+			span.WriteEnd = span.HandleEnd
+		}
+		c.traceLock.Unlock()
+		c.Server.SpanExporter.ExportSpan(span)
+		return
+	}
+
+	c.pendingSpans = append(c.pendingSpans, span)
+	c.traceLock.Unlock()
+}
+
+// writer写完n条消息后调用
+func (c *sKannaConnection) traceWritten(n int) {
+	if c.Server.SpanExporter == nil {
+		return
+	}
+
+	now := time.Now()
+	c.traceLock.Lock()
+	c.writtenSeq += uint64(n)
+	var done []*Span
+	rest := c.pendingSpans[:0]
+	for _, span := range c.pendingSpans {
+		if span.sendSeq <= c.writtenSeq {
+			span.WriteEnd = now
+			done = append(done, span)
+		} else {
+			rest = append(rest, span)
+		}
+	}
+	c.pendingSpans = rest
+	c.traceLock.Unlock()
+
+	for _, span := range done {
+		c.Server.SpanExporter.ExportSpan(span)
+	}
+}
+
+// 连接断开时导出还在等待写入的span, WriteEnd为零值
+func (c *sKannaConnection) flushSpans() {
+	if c.Server.SpanExporter == nil {
+		return
+	}
+
+	c.traceLock.Lock()
+	spans := c.pendingSpans
+	c.pendingSpans = nil
+	c.traceLock.Unlock()
+
+	for _, span := range spans {
+		c.Server.SpanExporter.ExportSpan(span)
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+const DefaultWriteQueueSize = 256
+const DefaultWriteBatchSize = 64
+
+func (c *KannaServer) writeQueueSize() int {
+	if c.WriteQueueSize > 0 {
+		return c.WriteQueueSize
+	}
+
+	return DefaultWriteQueueSize
+}
+
+func (c *KannaServer) writeBatchSize() int {
+	return c.live().writeBatchSize
+}
+
+// 从队列中取出待发送的消息合并成一次writev, 最多等待WriteLatency凑满一批
+func (c *sKannaConnection) collectBatch(first []byte) net.Buffers {
+	size := c.Server.writeBatchSize()
+	bufs := net.Buffers{first}
+
+	var wait <-chan time.Time
+	if latency := c.Server.writeLatency(); latency > 0 && size > 1 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		wait = timer.C
+	}
+
+	for len(bufs) < size {
+		if wait == nil {
+			select {
+			case data := <-c.msgChan:
+				bufs = append(bufs, data)
+			default:
+				return bufs
+			}
+		} else {
+			select {
+			case data := <-c.msgChan:
+				bufs = append(bufs, data)
+			case <-wait:
+				return bufs
+			}
+		}
+	}
+
+	return bufs
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// 走本地TCP, net.Pipe不支持writev, 看不出合并的效果
+func benchmarkWriter(b *testing.B, batchSize int) {
+	s := NewKananServer()
+	s.WriteBatchSize = batchSize
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan IKannaConnBehavior, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- s.ServeConn(c, nil)
+	}()
+
+	client, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	conn := <-accepted
+	if conn == nil {
+		b.Fatal("accept failed")
+	}
+	defer conn.Stop()
+
+	msg := benchOrderPack().Pack()
+	want := int64(b.N * len(msg))
+	done := make(chan int64)
+	go func() {
+		n, _ := io.CopyN(ioutil.Discard, client, want)
+		done <- n
+	}()
+
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.SendMsg(msg)
+	}
+
+	if n := <-done; n != want {
+		b.Fatalf("client read %d bytes, want %d", n, want)
+	}
+}
+
+// 对比一条消息一次write和默认的合并writev: go test -bench Writer -benchmem
+func BenchmarkWriter(b *testing.B) {
+	b.Run("batch=1", func(b *testing.B) {
+		benchmarkWriter(b, 1)
+	})
+
+	b.Run("batch=default", func(b *testing.B) {
+		benchmarkWriter(b, 0)
+	})
+}
@@ -99,12 +99,8 @@ func MsToTime(msInt int) time.Time {
 	return tm
 }
 
-func StrToBytes(str string) (ret []byte) {
-	for _, v := range str {
-		ret = append(ret, byte(v))
-	}
-
-	return ret
+func StrToBytes(str string) []byte {
+	return []byte(str)
 }
 
 func ExistsFile(path string) bool {
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStrToBytes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []byte
+	}{
+		{"", []byte{}},
+		{"BTC-USDT", []byte("BTC-USDT")},
+		{"部分交易", []byte{0xe9, 0x83, 0xa8, 0xe5, 0x88, 0x86, 0xe4, 0xba, 0xa4, 0xe6, 0x98, 0x93}},
+		{"a\x00b", []byte{'a', 0, 'b'}},
+	}
+
+	for _, tt := range tests {
+		if got := StrToBytes(tt.in); !bytes.Equal(got, tt.want) {
+			t.Errorf("StrToBytes(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
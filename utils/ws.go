@@ -113,7 +113,7 @@ func (ws *WsConn) Reconnect() {
 	}
 
 	for _, sub := range ws.subs {
-		log.Printf("[%s] re subscribe: ", ws.Url, string(sub))
+		log.Printf("[%s] re subscribe: %s", ws.Url, string(sub))
 		ws.SendMessage(sub)
 	}
 }